@@ -1,12 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -19,17 +26,81 @@ var (
 	transportFlag string
 	portFlag      int
 	noCacheFlag   bool
+	downloadFlag  bool
+	openapiFlag   string
+	cacheDirFlag  string
 	versionFlag   string
+	dryRunFlag    bool
+	configFlag    string
+	skipProbeFlag bool
+
+	identityHeaderFlag string
+
+	apiKeyCommandFlag    string
+	apiKeyCommandTTLFlag time.Duration
+
+	rateLimitFlag        string
+	sessionRateLimitFlag string
+	toolRateLimitFlags   []string
+	maxInflightFlag      int
+	toolTimeoutFlags     []string
+
+	approvalCommandFlag     string
+	approvalURLFlag         string
+	approvalTimeoutFlag     time.Duration
+	approvalDefaultDenyFlag bool
+
+	writeWindowFlag     time.Duration
+	writeWindowFileFlag string
+
+	authTokensFileFlag     string
+	authHMACSecretFileFlag string
+	authJWKSFileFlag       string
+	authIssuerFlag         string
+	authAudienceFlag       string
+
+	oauthAuthorizationServerFlag string
+	oauthJWKSURLFlag             string
+	oauthResourceFlag            string
+
+	drainTimeoutFlag time.Duration
+
+	listenFlag     string
+	socketModeFlag string
+
+	basePathFlag  string
+	publicURLFlag string
+
+	allowedOriginFlags []string
+
+	healthFlag      bool
+	debugToolsFlag  bool
+	adminListenFlag string
+
+	tlsCertFlag  string
+	tlsKeyFlag   string
+	clientCAFlag string
 )
 
 var rootCmd = &cobra.Command{
-	Use:     "mcp-querypie <querypie-url>",
+	Use:     "mcp-querypie <querypie-url> | --config <file>",
 	Short:   "Run the MCP Server for QueryPie",
 	Long:    `Run the MCP Server for QueryPie.`,
 	Version: consts.Version,
 	Example: `  QUERYPIE_API_KEY=ap111111 mcp-querypie https://api.querypie.com --transport stdio
-  QUERYPIE_API_KEY=ap111111 mcp-querypie https://api.querypie.com --transport sse --port 8000`,
+  QUERYPIE_API_KEY=ap111111 mcp-querypie https://api.querypie.com --transport sse --port 8000
+  QUERYPIE_API_KEY=ap111111 mcp-querypie https://api.querypie.com --transport http --port 8000
+  QUERYPIE_API_KEY_FILE=/run/secrets/querypie-api-key mcp-querypie https://api.querypie.com
+  QUERYPIE_READ_API_KEY=ap111111 QUERYPIE_WRITE_API_KEY=ap222222 mcp-querypie https://api.querypie.com
+  mcp-querypie --config instances.yaml --transport sse`,
 	Args: cobra.MatchAll(func(cmd *cobra.Command, args []string) error {
+		if configFlag != "" {
+			if len(args) > 0 {
+				return fmt.Errorf("argument <querypie-url> cannot be used with --config")
+			}
+			return nil
+		}
+
 		if len(args) == 0 {
 			return fmt.Errorf("argument <querypie-url> is required")
 		}
@@ -41,34 +112,274 @@ var rootCmd = &cobra.Command{
 		return nil
 	}),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
-		defer stop()
-
-		// Check environment varaibles
-		querypieAPIKey := os.Getenv("QUERYPIE_API_KEY")
-		if querypieAPIKey == "" {
-			return errors.New("QUERYPIE_API_KEY is not set")
-		} else if len(querypieAPIKey) != 38 && strings.HasPrefix(querypieAPIKey, "ap") {
-			return errors.New("malformed QUERYPIE_API_KEY. please check the API key")
-		}
+		// The first SIGINT or SIGTERM stops the server gracefully, and a second one exits at once
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		go func() {
+			sig := <-signals
+			slog.Info("• Received a signal. Stopping the server", "signal", sig)
+			cancel()
+			sig = <-signals
+			slog.Warn("• Received a second signal. Exiting immediately", "signal", sig)
+			os.Exit(1)
+		}()
 
 		// Check positional arguments
-		if len(args) == 0 {
+		if len(args) == 0 && configFlag == "" {
 			return fmt.Errorf("querypie-url is required")
 		}
 
 		// Check flags
 		transport := transportFlag
-		if transport != "stdio" && transport != "sse" {
+		if transport != "stdio" && transport != "sse" && transport != "http" {
 			return fmt.Errorf("invalid transport: %s", transport)
 		}
 
+		// Check environment varaibles
+		// Over the network transports, each client may send its own QueryPie API key instead
+		querypieAPIKey := os.Getenv("QUERYPIE_API_KEY")
+		querypieAPIKeyFile := os.Getenv("QUERYPIE_API_KEY_FILE")
+
+		// A low-privilege key for reading and a separate key for mutating tools may be used instead
+		readAPIKey := os.Getenv("QUERYPIE_READ_API_KEY")
+		readAPIKeyFile := os.Getenv("QUERYPIE_READ_API_KEY_FILE")
+		writeAPIKey := os.Getenv("QUERYPIE_WRITE_API_KEY")
+		writeAPIKeyFile := os.Getenv("QUERYPIE_WRITE_API_KEY_FILE")
+		separateKeys := readAPIKey != "" || readAPIKeyFile != "" || writeAPIKey != "" || writeAPIKeyFile != ""
+		if separateKeys {
+			if querypieAPIKey != "" || querypieAPIKeyFile != "" || apiKeyCommandFlag != "" {
+				return errors.New("QUERYPIE_READ_API_KEY and QUERYPIE_WRITE_API_KEY cannot be used with QUERYPIE_API_KEY, QUERYPIE_API_KEY_FILE or --api-key-command")
+			}
+			if readAPIKey != "" && readAPIKeyFile != "" {
+				return errors.New("only one of QUERYPIE_READ_API_KEY and QUERYPIE_READ_API_KEY_FILE is allowed")
+			}
+			if writeAPIKey != "" && writeAPIKeyFile != "" {
+				return errors.New("only one of QUERYPIE_WRITE_API_KEY and QUERYPIE_WRITE_API_KEY_FILE is allowed")
+			}
+			if readAPIKey == "" && readAPIKeyFile == "" {
+				return errors.New("QUERYPIE_WRITE_API_KEY requires QUERYPIE_READ_API_KEY")
+			}
+			if malformedAPIKey(writeAPIKey) {
+				return errors.New("malformed QUERYPIE_WRITE_API_KEY. please check the API key")
+			}
+			querypieAPIKey = readAPIKey
+			querypieAPIKeyFile = readAPIKeyFile
+		}
+
+		keySources := 0
+		for _, source := range []string{querypieAPIKey, querypieAPIKeyFile, apiKeyCommandFlag} {
+			if source != "" {
+				keySources++
+			}
+		}
+
+		// Each instance of the config file has its own key source
+		var instances []server.InstanceConfig
+		if configFlag != "" {
+			if keySources > 0 || separateKeys {
+				return errors.New("QUERYPIE_API_KEY and the other key sources cannot be used with --config. set the key of each instance in the config file")
+			}
+			var err error
+			instances, err = server.LoadInstancesFile(configFlag)
+			if err != nil {
+				return err
+			}
+		}
+		if keySources > 1 {
+			return errors.New("only one of QUERYPIE_API_KEY, QUERYPIE_API_KEY_FILE and --api-key-command is allowed")
+		}
+
+		if keySources == 0 {
+			if transport == "stdio" && configFlag == "" {
+				return errors.New("QUERYPIE_API_KEY is not set")
+			}
+		} else if malformedAPIKey(querypieAPIKey) {
+			return errors.New("malformed QUERYPIE_API_KEY. please check the API key")
+		}
+
 		port := portFlag
 		if port < 0 || port > 65535 {
 			return fmt.Errorf("invalid port: %d", port)
 		}
 
-		server := server.NewServer(querypieAPIKey, args[0], transport, port, server.NewPromptServerOptions()...)
+		if listenFlag != "" {
+			if cmd.Flags().Changed("port") {
+				return errors.New("only one of --listen and --port is allowed")
+			}
+			if !validListenAddress(listenFlag) {
+				return fmt.Errorf("invalid listen address: %s", listenFlag)
+			}
+		}
+
+		if (healthFlag || debugToolsFlag) && transport == "stdio" {
+			return errors.New("--health and --debug-tools are only for the sse and http transports")
+		}
+		// the MCP listener may be public, and /debug/tools is not behind client authentication
+		if debugToolsFlag && adminListenFlag == "" && os.Getenv("QUERYPIE_MCP_ADMIN_TOKEN") == "" {
+			return errors.New("--debug-tools requires --admin-listen or QUERYPIE_MCP_ADMIN_TOKEN")
+		}
+		if adminListenFlag != "" {
+			if !healthFlag && !debugToolsFlag {
+				return errors.New("--admin-listen requires --health or --debug-tools")
+			}
+			if !validListenAddress(adminListenFlag) {
+				return fmt.Errorf("invalid admin listen address: %s", adminListenFlag)
+			}
+		}
+		if drainTimeoutFlag < 0 {
+			return fmt.Errorf("invalid drain-timeout: %s", drainTimeoutFlag)
+		}
+
+		socketMode, err := strconv.ParseUint(socketModeFlag, 8, 32)
+		if err != nil || socketMode > 0o777 {
+			return fmt.Errorf("invalid socket-mode: %s", socketModeFlag)
+		}
+
+		if approvalCommandFlag != "" && approvalURLFlag != "" {
+			return errors.New("only one of --approval-command and --approval-url is allowed")
+		}
+		if approvalURLFlag != "" {
+			if u, err := url.Parse(approvalURLFlag); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("invalid approval-url: %s", approvalURLFlag)
+			}
+		}
+
+		if writeWindowFlag < 0 {
+			return fmt.Errorf("invalid write-window: %s", writeWindowFlag)
+		}
+		if writeWindowFileFlag != "" && writeWindowFlag == 0 {
+			return errors.New("--write-window-file requires --write-window")
+		}
+
+		if basePathFlag != "" && (!strings.HasPrefix(basePathFlag, "/") || strings.ContainsAny(basePathFlag, "?#")) {
+			return fmt.Errorf("invalid base-path: %s. it must start with /", basePathFlag)
+		}
+		var publicURL *url.URL
+		if publicURLFlag != "" {
+			u, err := url.Parse(publicURLFlag)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+				return fmt.Errorf("invalid public-url: %s", publicURLFlag)
+			}
+			publicURL = u
+		}
+		for _, origin := range allowedOriginFlags {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+				return fmt.Errorf("invalid allowed-origin: %s. use scheme://host[:port]", origin)
+			}
+		}
+
+		// the public URL is where OAuth clients reach this server, so it is the resource by default
+		if oauthResourceFlag == "" && oauthAuthorizationServerFlag != "" {
+			oauthResourceFlag = publicURLFlag
+		}
+		if oauthAuthorizationServerFlag != "" && oauthResourceFlag == "" {
+			return errors.New("--oauth-authorization-server requires --oauth-resource or --public-url")
+		}
+		if (oauthJWKSURLFlag != "" || oauthResourceFlag != "") && oauthAuthorizationServerFlag == "" {
+			return errors.New("--oauth-jwks-url and --oauth-resource require --oauth-authorization-server")
+		}
+
+		// a valid signature alone does not say a token is meant for this server
+		if (authHMACSecretFileFlag != "" || authJWKSFileFlag != "") && authAudienceFlag == "" {
+			return errors.New("--auth-hmac-secret-file and --auth-jwks-file require --auth-audience")
+		}
+		if authJWKSFileFlag != "" && authIssuerFlag == "" {
+			return errors.New("--auth-jwks-file requires --auth-issuer")
+		}
+
+		if (tlsCertFlag == "") != (tlsKeyFlag == "") {
+			return errors.New("--tls-cert and --tls-key must be set together")
+		}
+		if clientCAFlag != "" && tlsCertFlag == "" {
+			return errors.New("--client-ca requires --tls-cert and --tls-key")
+		}
+		if tlsCertFlag != "" && transport == "stdio" {
+			return errors.New("--tls-cert is only for the sse and http transports")
+		}
+
+		if identityHeaderFlag != "" {
+			if !headerNamePattern.MatchString(identityHeaderFlag) {
+				return fmt.Errorf("invalid identity-header: %s", identityHeaderFlag)
+			}
+			if strings.EqualFold(identityHeaderFlag, "Authorization") || strings.EqualFold(identityHeaderFlag, "Content-Type") {
+				return fmt.Errorf("identity-header cannot be %s", identityHeaderFlag)
+			}
+		}
+
+		rateLimits, err := parseRateLimitFlags()
+		if err != nil {
+			return err
+		}
+		toolTimeouts, err := parseToolTimeoutFlags()
+		if err != nil {
+			return err
+		}
+
+		opts := []server.Option{
+			server.WithServerOptions(server.NewPromptServerOptions()...),
+			server.WithAPIKeyFile(querypieAPIKeyFile),
+			server.WithAPIKeyCommand(apiKeyCommandFlag, apiKeyCommandTTLFlag),
+			server.WithRateLimits(rateLimits),
+			server.WithToolTimeouts(toolTimeouts),
+			server.WithDryRun(dryRunFlag),
+			server.WithSkipProbe(skipProbeFlag),
+			server.WithSpecDownload(downloadFlag),
+			server.WithOpenAPI(openapiFlag),
+			server.WithCacheDir(cacheDirFlag),
+			server.WithIdentityHeader(identityHeaderFlag),
+			server.WithApproval(server.ApprovalConfig{
+				Command:     approvalCommandFlag,
+				URL:         approvalURLFlag,
+				Timeout:     approvalTimeoutFlag,
+				DefaultDeny: approvalDefaultDenyFlag,
+			}),
+			server.WithWriteWindow(server.WriteWindowConfig{
+				Duration:    writeWindowFlag,
+				ControlFile: writeWindowFileFlag,
+				AdminToken:  os.Getenv("QUERYPIE_MCP_ADMIN_TOKEN"),
+			}),
+			server.WithInboundAuth(server.InboundAuthConfig{
+				TokensFile:     authTokensFileFlag,
+				HMACSecretFile: authHMACSecretFileFlag,
+				JWKSFile:       authJWKSFileFlag,
+				Issuer:         authIssuerFlag,
+				Audience:       authAudienceFlag,
+
+				AuthorizationServer: oauthAuthorizationServerFlag,
+				JWKSURL:             oauthJWKSURLFlag,
+				Resource:            oauthResourceFlag,
+			}),
+			server.WithDrainTimeout(drainTimeoutFlag),
+			server.WithListen(listenFlag, os.FileMode(socketMode)),
+			server.WithPublicAddress(basePathFlag, publicURL),
+			server.WithAllowedOrigins(allowedOriginFlags),
+			server.WithHealth(server.HealthConfig{
+				Enabled:     healthFlag,
+				DebugTools:  debugToolsFlag,
+				AdminListen: adminListenFlag,
+			}),
+			server.WithTLS(server.TLSConfig{
+				CertFile:     tlsCertFlag,
+				KeyFile:      tlsKeyFlag,
+				ClientCAFile: clientCAFlag,
+			}),
+		}
+		if separateKeys {
+			opts = append(opts, server.WithWriteAPIKey(writeAPIKey, writeAPIKeyFile))
+		}
+
+		var querypieURL string
+		if len(instances) > 0 {
+			opts = append(opts, server.WithInstances(instances))
+		} else {
+			querypieURL = args[0]
+		}
+
+		server := server.NewServer(querypieAPIKey, querypieURL, transport, port, opts...)
 		return server.Start(ctx, noCacheFlag, versionFlag)
 	},
 }
@@ -85,10 +396,134 @@ func init() {
 	slog.SetDefault(logger)
 
 	// Set up command flags
-	rootCmd.Flags().StringVarP(&transportFlag, "transport", "t", "stdio", "transport mode (stdio|sse)")
-	rootCmd.Flags().IntVarP(&portFlag, "port", "p", 8000, "port number if transport is sse")
-	rootCmd.Flags().BoolVarP(&noCacheFlag, "no-cache", "f", false, "do not cache the OpenAPI specification")
+	rootCmd.Flags().StringVarP(&transportFlag, "transport", "t", "stdio", "transport mode (stdio|sse|http). http is the Streamable HTTP transport served at /mcp")
+	rootCmd.Flags().IntVarP(&portFlag, "port", "p", 8000, "port number if transport is sse or http")
+	rootCmd.Flags().DurationVar(&drainTimeoutFlag, "drain-timeout", server.DefaultDrainTimeout, "how long running tool calls may take to finish on SIGINT or SIGTERM. new calls are rejected meanwhile,\nand a second signal exits at once")
+	rootCmd.Flags().StringVar(&listenFlag, "listen", "", "address to listen on instead of all interfaces on --port, such as 127.0.0.1:8000, [::1]:8000\nor unix:///run/querypie-mcp.sock. a socket passed by systemd socket activation (LISTEN_FDS) takes precedence")
+	rootCmd.Flags().StringVar(&socketModeFlag, "socket-mode", "0660", "permissions of the unix socket of --listen")
+	rootCmd.Flags().StringVar(&openapiFlag, "openapi", "", "OpenAPI specification to use instead of the one of the QueryPie version, in YAML or JSON.\na file path, a file:// URL or an https:// URL such as the api-docs endpoint of QueryPie")
+	rootCmd.Flags().BoolVar(&downloadFlag, "download-openapi", false, "download the OpenAPI specification from the latest GitHub release if the QueryPie version is not bundled in the binary")
+	rootCmd.Flags().StringVar(&cacheDirFlag, "cache-dir", "", "directory caching the downloaded OpenAPI specifications (default $XDG_CACHE_HOME/querypie-mcp-server)")
+	rootCmd.Flags().BoolVarP(&noCacheFlag, "no-cache", "f", false, "do not cache the downloaded OpenAPI specification")
+	rootCmd.Flags().StringVar(&identityHeaderFlag, "identity-header", "", "header sending the user of each tool call to QueryPie (e.g. X-Forwarded-User).\nit is the authenticated client, or else the clientInfo name of the MCP client")
+	rootCmd.Flags().StringVar(&configFlag, "config", "", "config file of several QueryPie instances to serve, instead of <querypie-url>.\nthe tools of each instance are prefixed with its name")
 	rootCmd.Flags().StringVar(&versionFlag, "querypie-version", "", "QueryPie version to use (e.g. 10.2.8).\nif not specified, automatically detect the version from the QueryPie server.")
+	rootCmd.Flags().StringVar(&apiKeyCommandFlag, "api-key-command", "", "command printing the QueryPie API key, instead of QUERYPIE_API_KEY or QUERYPIE_API_KEY_FILE")
+	rootCmd.Flags().DurationVar(&apiKeyCommandTTLFlag, "api-key-command-ttl", server.DefaultAPIKeyCommandTTL, "how long the output of --api-key-command is cached")
+	rootCmd.Flags().BoolVar(&dryRunFlag, "dry-run", false, "do not send requests to QueryPie. tools return the rendered request instead")
+	rootCmd.Flags().BoolVar(&skipProbeFlag, "skip-probe", false, "do not verify the QueryPie API key at startup, and keep the tools of the API areas it may not be able to use")
+	rootCmd.Flags().StringVar(&rateLimitFlag, "rate-limit", "", "global rate limit of tool calls as rate[:burst] in requests per second (e.g. 10:20)")
+	rootCmd.Flags().StringVar(&sessionRateLimitFlag, "session-rate-limit", "", "rate limit of tool calls per MCP session as rate[:burst]")
+	rootCmd.Flags().StringArrayVar(&toolRateLimitFlags, "tool-rate-limit", nil, "rate limit of each tool as rate[:burst], or of a specific tool as <tool>=rate[:burst].\ncan be repeated (e.g. --tool-rate-limit 5 --tool-rate-limit v2_list_activity_logs=0.5:2)")
+	rootCmd.Flags().IntVar(&maxInflightFlag, "max-inflight", 0, "maximum number of concurrent requests to QueryPie. 0 means unlimited")
+	rootCmd.Flags().StringArrayVar(&toolTimeoutFlags, "tool-timeout", nil, "how long the request of each tool to QueryPie may take, or of a specific tool as <tool>=<duration>.\ncan be repeated. 0 means no limit (default 2m, e.g. --tool-timeout 30s --tool-timeout v2_run_audit_export_task=10m)")
+	rootCmd.Flags().StringVar(&approvalCommandFlag, "approval-command", "", "command to approve each mutating tool call. it receives the request as JSON on stdin,\nand approves the call by exiting with 0 (or printing {\"approved\": false, \"reason\": \"...\"} to deny it)")
+	rootCmd.Flags().StringVar(&approvalURLFlag, "approval-url", "", "URL of an approval service to approve each mutating tool call. it receives the request as a JSON POST,\nand must respond 2xx with {\"approved\": true|false, \"reason\": \"...\"}")
+	rootCmd.Flags().DurationVar(&approvalTimeoutFlag, "approval-timeout", server.DefaultApprovalTimeout, "how long to wait for the approval hook")
+	rootCmd.Flags().BoolVar(&approvalDefaultDenyFlag, "approval-default-deny", true, "deny the call if the approval hook fails or times out. if false, the call proceeds")
+	rootCmd.Flags().DurationVar(&writeWindowFlag, "write-window", 0, "start read-only and enable mutating tools only for this long once a write window is opened (e.g. 15m).\nopen it with SIGUSR1 (SIGUSR2 closes it), the control file, or POST /admin/write-window in SSE or HTTP mode\nwith QUERYPIE_MCP_ADMIN_TOKEN as the bearer token")
+	rootCmd.Flags().StringVar(&writeWindowFileFlag, "write-window-file", "", "control file that opens the write window when created or touched, and closes it when removed.\nit may contain a duration overriding --write-window")
+	rootCmd.Flags().StringVar(&authTokensFileFlag, "auth-tokens-file", "", "file of static bearer tokens MCP clients must send in SSE or HTTP mode, one \"<token> [name]\" per line")
+	rootCmd.Flags().StringVar(&authHMACSecretFileFlag, "auth-hmac-secret-file", "", "file containing the shared secret of HS256 signed JWTs MCP clients may send in SSE or HTTP mode")
+	rootCmd.Flags().StringVar(&authJWKSFileFlag, "auth-jwks-file", "", "JWKS file of the public keys of RS256/ES256 signed JWTs MCP clients may send in SSE or HTTP mode")
+	rootCmd.Flags().StringVar(&authIssuerFlag, "auth-issuer", "", "expected issuer (iss) of client JWTs. required with --auth-jwks-file")
+	rootCmd.Flags().StringVar(&authAudienceFlag, "auth-audience", "", "expected audience (aud) of client JWTs. required with --auth-hmac-secret-file and --auth-jwks-file")
+	rootCmd.Flags().StringVar(&oauthAuthorizationServerFlag, "oauth-authorization-server", "", "issuer URL of the OAuth authorization server whose access tokens MCP clients may send in SSE or HTTP mode.\nits JWKS is discovered from the authorization server metadata")
+	rootCmd.Flags().StringVar(&oauthJWKSURLFlag, "oauth-jwks-url", "", "JWKS URL of the OAuth authorization server, instead of discovering it")
+	rootCmd.Flags().StringVar(&oauthResourceFlag, "oauth-resource", "", "public URL of this server (e.g. https://mcp.example.com). access tokens must be issued for it,\nunless --auth-audience is set. defaults to --public-url")
+	rootCmd.Flags().StringVar(&basePathFlag, "base-path", "", "path prefix of the MCP endpoints, for a reverse proxy forwarding /mcp/querypie/... as is (e.g. /mcp/querypie)")
+	rootCmd.Flags().StringArrayVar(&allowedOriginFlags, "allowed-origin", nil, "origin of browser pages allowed to call the http transport besides localhost and --public-url,\nsuch as https://app.example.com. can be repeated")
+	rootCmd.Flags().StringVar(&publicURLFlag, "public-url", "", "URL clients reach the server at through a reverse proxy (e.g. https://gw.example.com/mcp/querypie).\nthe SSE message endpoint is advertised with it, or else with X-Forwarded-Proto and X-Forwarded-Host")
+	rootCmd.Flags().BoolVar(&healthFlag, "health", false, "serve /healthz for liveness, and /readyz reporting whether the tools are loaded and QueryPie is reachable")
+	rootCmd.Flags().BoolVar(&debugToolsFlag, "debug-tools", false, "serve /debug/tools listing the tools and the QueryPie operations they come from.\nit requires QUERYPIE_MCP_ADMIN_TOKEN as the bearer token if set, and either the token or --admin-listen")
+	rootCmd.Flags().StringVar(&adminListenFlag, "admin-listen", "", "address to serve /healthz, /readyz and /debug/tools on instead of the MCP address, such as :9090")
+	rootCmd.Flags().StringVar(&tlsCertFlag, "tls-cert", "", "PEM certificate to serve the sse and http transports over TLS. reloaded when it changes")
+	rootCmd.Flags().StringVar(&tlsKeyFlag, "tls-key", "", "PEM private key of --tls-cert")
+	rootCmd.Flags().StringVar(&clientCAFlag, "client-ca", "", "PEM CA certificates. MCP clients must present a certificate signed by one of them (mutual TLS)")
+}
+
+// validListenAddress reports whether the address is host:port or unix://<path>.
+func validListenAddress(address string) bool {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		return path != ""
+	}
+	_, _, err := net.SplitHostPort(address)
+	return err == nil
+}
+
+// headerNamePattern matches the token characters allowed in HTTP header names.
+var headerNamePattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// malformedAPIKey reports whether a key set in an environment variable is not a QueryPie API key.
+func malformedAPIKey(key string) bool {
+	return key != "" && (len(key) != 38 || !strings.HasPrefix(key, "ap"))
+}
+
+func parseRateLimitFlags() (server.RateLimitConfig, error) {
+	config := server.RateLimitConfig{
+		Tools:       make(map[string]server.RateLimit),
+		MaxInflight: maxInflightFlag,
+	}
+
+	if maxInflightFlag < 0 {
+		return config, fmt.Errorf("invalid max-inflight: %d", maxInflightFlag)
+	}
+
+	var err error
+	if rateLimitFlag != "" {
+		if config.Global, err = server.ParseRateLimit(rateLimitFlag); err != nil {
+			return config, fmt.Errorf("invalid rate-limit: %w", err)
+		}
+	}
+	if sessionRateLimitFlag != "" {
+		if config.Session, err = server.ParseRateLimit(sessionRateLimitFlag); err != nil {
+			return config, fmt.Errorf("invalid session-rate-limit: %w", err)
+		}
+	}
+	for _, value := range toolRateLimitFlags {
+		name, limitStr, hasName := strings.Cut(value, "=")
+		if !hasName {
+			limitStr = value
+		}
+
+		limit, err := server.ParseRateLimit(limitStr)
+		if err != nil {
+			return config, fmt.Errorf("invalid tool-rate-limit %q: %w", value, err)
+		}
+
+		if hasName {
+			config.Tools[strings.TrimSpace(name)] = limit
+		} else {
+			config.Tool = limit
+		}
+	}
+
+	return config, nil
+}
+
+func parseToolTimeoutFlags() (server.ToolTimeouts, error) {
+	timeouts := server.ToolTimeouts{
+		Default: server.DefaultToolTimeout,
+		Tools:   make(map[string]time.Duration),
+	}
+	for _, value := range toolTimeoutFlags {
+		name, timeoutStr, hasName := strings.Cut(value, "=")
+		if !hasName {
+			timeoutStr = value
+		}
+
+		timeout, err := time.ParseDuration(strings.TrimSpace(timeoutStr))
+		if err != nil || timeout < 0 {
+			return timeouts, fmt.Errorf("invalid tool-timeout %q", value)
+		}
+
+		if hasName {
+			timeouts.Tools[strings.TrimSpace(name)] = timeout
+		} else {
+			timeouts.Default = timeout
+		}
+	}
+	return timeouts, nil
 }
 
 func Execute() {
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/querypie/querypie-mcp-server/server"
+)
+
+var specVersionFlag string
+
+var specCmd = &cobra.Command{
+	Use:   "spec [<querypie-url>]",
+	Short: "Show the bundled OpenAPI specifications, and the one used for a QueryPie version",
+	Example: `  mcp-querypie spec
+  mcp-querypie spec --querypie-version 10.2.9
+  mcp-querypie spec https://api.querypie.com`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var versions []string
+		for _, version := range server.SpecVersions() {
+			versions = append(versions, version.String())
+		}
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "Bundled OpenAPI specifications: %s\n", strings.Join(versions, ", "))
+
+		var version *server.Version
+		var err error
+		switch {
+		case specVersionFlag != "":
+			version, err = server.NewVersionFromString(strings.TrimSpace(specVersionFlag))
+		case len(args) == 1:
+			ctx, cancel := context.WithTimeout(cmd.Context(), 10*time.Second)
+			defer cancel()
+			version, err = server.GetVersion(ctx, args[0])
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resolution := server.ResolveSpecVersion(*version)
+		fmt.Fprintln(out, resolution)
+		if resolution.Newer {
+			fmt.Fprintln(out, "It is newer than every bundled specification. Use --download-openapi or --openapi for its own.")
+		}
+		return nil
+	},
+}
+
+func init() {
+	specCmd.Flags().StringVar(&specVersionFlag, "querypie-version", "", "QueryPie version to resolve (e.g. 10.2.9), instead of asking <querypie-url>")
+	rootCmd.AddCommand(specCmd)
+}
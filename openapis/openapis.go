@@ -0,0 +1,39 @@
+// Package openapis bundles the OpenAPI specifications of the QueryPie versions known at build time,
+// so the server starts without downloading them.
+package openapis
+
+import (
+	"embed"
+	"strings"
+)
+
+const filenameSuffix = "-openapi.yaml"
+
+//go:embed *-openapi.yaml
+var files embed.FS
+
+// Filename is the name of the specification of a version such as v10.2.8, as bundled and released.
+func Filename(version string) string {
+	return strings.ReplaceAll(version, ".", "-") + filenameSuffix
+}
+
+// Lookup returns the bundled specification of a version such as v10.2.8, or false if it is not bundled.
+func Lookup(version string) ([]byte, bool) {
+	spec, err := files.ReadFile(Filename(version))
+	if err != nil {
+		return nil, false
+	}
+	return spec, true
+}
+
+// Versions returns the versions whose specification is bundled, such as v10.2.8.
+func Versions() []string {
+	entries, _ := files.ReadDir(".")
+	var versions []string
+	for _, entry := range entries {
+		if version, ok := strings.CutSuffix(entry.Name(), filenameSuffix); ok {
+			versions = append(versions, strings.ReplaceAll(version, "-", "."))
+		}
+	}
+	return versions
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAPIKeyCommandTTL = 5 * time.Minute
+	apiKeyFilePollInterval  = 5 * time.Second
+	apiKeyCommandTimeout    = 30 * time.Second
+)
+
+// apiKeySource provides the server's own QueryPie API key.
+type apiKeySource interface {
+	APIKey(ctx context.Context) (string, error)
+}
+
+// staticAPIKey is a key that never changes, such as one read from QUERYPIE_API_KEY.
+type staticAPIKey string
+
+func (k staticAPIKey) APIKey(ctx context.Context) (string, error) {
+	return string(k), nil
+}
+
+// fileAPIKey reads the key from a file, such as a Docker or Kubernetes secret, and reloads it when the file changes.
+type fileAPIKey struct {
+	filename string
+
+	mu      sync.RWMutex
+	key     string
+	modTime time.Time
+}
+
+func newFileAPIKey(filename string) (*fileAPIKey, error) {
+	k := &fileAPIKey{filename: filename}
+	if _, err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *fileAPIKey) APIKey(ctx context.Context) (string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.key, nil
+}
+
+// reload reads the file again if it has changed since the last read.
+func (k *fileAPIKey) reload() (bool, error) {
+	info, err := os.Stat(k.filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to read API key file: %w", err)
+	}
+
+	k.mu.RLock()
+	unchanged := info.ModTime().Equal(k.modTime)
+	k.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	content, err := os.ReadFile(k.filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to read API key file: %w", err)
+	}
+	key := strings.TrimSpace(string(content))
+	if key == "" {
+		return false, fmt.Errorf("API key file %s is empty", k.filename)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	changed := k.key != key
+	k.key = key
+	k.modTime = info.ModTime()
+	return changed, nil
+}
+
+// watch polls the file until ctx is done. A rotated key is used for subsequent calls.
+func (k *fileAPIKey) watch(ctx context.Context) {
+	ticker := time.NewTicker(apiKeyFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := k.reload()
+			if err != nil {
+				// keep using the last key, the file may be in the middle of being replaced
+				slog.Warn("• Failed to reload API key file. Keeping the current key", "error", err)
+			} else if changed {
+				slog.Info("• API key is rotated", "file", k.filename)
+			}
+		}
+	}
+}
+
+// commandAPIKey runs a command, such as a secret manager CLI, and caches its output for a while.
+// Once the key is outdated, it is still used while the command runs again in the background.
+type commandAPIKey struct {
+	command string
+	ttl     time.Duration
+
+	mu         sync.Mutex
+	key        string
+	fetchedAt  time.Time
+	refreshing chan struct{} // closed when the running command is done, nil if none runs
+	err        error         // of the last run
+}
+
+func newCommandAPIKey(command string, ttl time.Duration) *commandAPIKey {
+	if ttl <= 0 {
+		ttl = DefaultAPIKeyCommandTTL
+	}
+	return &commandAPIKey{command: command, ttl: ttl}
+}
+
+func (k *commandAPIKey) APIKey(ctx context.Context) (string, error) {
+	k.mu.Lock()
+	if k.key != "" && time.Since(k.fetchedAt) < k.ttl {
+		defer k.mu.Unlock()
+		return k.key, nil
+	}
+
+	// concurrent calls share a single run of the command
+	done := k.refreshing
+	if done == nil {
+		done = make(chan struct{})
+		k.refreshing = done
+		go k.refresh(done)
+	}
+	if k.key != "" {
+		defer k.mu.Unlock()
+		return k.key, nil
+	}
+	k.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.key == "" {
+		return "", k.err
+	}
+	return k.key, nil
+}
+
+// refresh runs the command without holding the lock. It is not bound to the call that started it,
+// as other calls wait for it too.
+func (k *commandAPIKey) refresh(done chan struct{}) {
+	key, err := k.run(context.Background())
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	defer close(done)
+	k.refreshing = nil
+	k.err = err
+
+	if err != nil {
+		if k.key != "" {
+			slog.Warn("• Failed to refresh API key from command. Keeping the current key", "error", err)
+		}
+		return
+	}
+	if k.key != "" && k.key != key {
+		slog.Info("• API key is rotated by the API key command")
+	}
+	k.key = key
+	k.fetchedAt = time.Now()
+}
+
+func (k *commandAPIKey) run(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiKeyCommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := shellCommand(ctx, k.command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", fmt.Errorf("failed to run API key command: %w", err)
+	}
+
+	key := strings.TrimSpace(stdout.String())
+	if key == "" {
+		return "", errors.New("API key command printed nothing")
+	}
+	return key, nil
+}
+
+// newAPIKeySource returns where the server's own API key comes from, or nil if it has none.
+func (s *Server) newAPIKeySource(ctx context.Context) (apiKeySource, error) {
+	return newAPIKeySource(ctx, s.querypieAPIKey, s.apiKeyFile, s.apiKeyCommand, s.apiKeyCommandTTL)
+}
+
+// newAPIKeySource returns the first configured source of a command, a file and a static key, or nil.
+func newAPIKeySource(ctx context.Context, key, filename, command string, ttl time.Duration) (apiKeySource, error) {
+	switch {
+	case command != "":
+		source := newCommandAPIKey(command, ttl)
+		// fail fast on a broken command
+		if _, err := source.APIKey(ctx); err != nil {
+			return nil, err
+		}
+		slog.Info("   ✔ QueryPie API key is read from a command", "ttl", source.ttl)
+		return source, nil
+	case filename != "":
+		source, err := newFileAPIKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		go source.watch(ctx)
+		slog.Info("   ✔ QueryPie API key is read from a file", "file", filename)
+		return source, nil
+	case key != "":
+		return staticAPIKey(key), nil
+	default:
+		return nil, nil
+	}
+}
+
+// newWriteAPIKeySource returns the key of mutating tools. It is the server's own key
+// unless a separate write key is configured, and nil if mutating tools must be disabled.
+func (s *Server) newWriteAPIKeySource(ctx context.Context, readKeys apiKeySource) (apiKeySource, error) {
+	if !s.separateWriteKey {
+		return readKeys, nil
+	}
+
+	switch {
+	case s.writeAPIKeyFile != "":
+		source, err := newFileAPIKey(s.writeAPIKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read write API key: %w", err)
+		}
+		go source.watch(ctx)
+		slog.Info("   ✔ QueryPie write API key is read from a file", "file", s.writeAPIKeyFile)
+		return source, nil
+	case s.writeAPIKey != "":
+		return staticAPIKey(s.writeAPIKey), nil
+	default:
+		return nil, nil
+	}
+}
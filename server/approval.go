@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const DefaultApprovalTimeout = 2 * time.Minute
+
+// ApprovalConfig configures the hook asked for a verdict before each mutating tool call.
+// Either Command or URL must be set for the hook to be enabled.
+type ApprovalConfig struct {
+	Command     string        // command line run through the shell. the request is written to its stdin
+	URL         string        // HTTP endpoint the request is POSTed to
+	Timeout     time.Duration // how long to wait for a verdict
+	DefaultDeny bool          // deny the call when the hook fails or times out
+}
+
+func (c ApprovalConfig) enabled() bool {
+	return c.Command != "" || c.URL != ""
+}
+
+// approvalRequest is sent to the hook as JSON.
+type approvalRequest struct {
+	Instance    string                 `json:"instance,omitempty"`
+	Tool        string                 `json:"tool"`
+	Arguments   map[string]interface{} `json:"arguments,omitempty"`
+	Request     renderedRequest        `json:"request"`
+	SessionID   string                 `json:"sessionId,omitempty"`
+	ActingUser  string                 `json:"actingUser,omitempty"`
+	RequestedAt time.Time              `json:"requestedAt"`
+}
+
+// approvalVerdict is the answer of the hook.
+type approvalVerdict struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type approver struct {
+	config     ApprovalConfig
+	httpClient *http.Client
+}
+
+func newApprover(config ApprovalConfig) *approver {
+	if !config.enabled() {
+		return nil
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultApprovalTimeout
+	}
+	return &approver{
+		config:     config,
+		httpClient: &http.Client{},
+	}
+}
+
+func (a *approver) middleware(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	if !tool.mutating() {
+		return next
+	}
+
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if dryRunFromContext(ctx) {
+			return next(ctx, request)
+		}
+
+		req, body, err := tool.operation.buildRequest(ctx, tool.client.baseURL, request.Params.Arguments)
+		var argErr *argumentError
+		if errors.As(err, &argErr) {
+			return mcp.NewToolResultError(argErr.Error()), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		approval := approvalRequest{
+			Instance:    tool.client.instance,
+			Tool:        tool.Tool.Name,
+			Arguments:   request.Params.Arguments,
+			Request:     renderRequest(req, body),
+			RequestedAt: time.Now().UTC(),
+		}
+		if session := server.ClientSessionFromContext(ctx); session != nil {
+			approval.SessionID = session.SessionID()
+		}
+		if user := actingUserFromContext(ctx); user != nil {
+			approval.ActingUser = user.value
+		}
+
+		verdict := a.ask(ctx, approval)
+		if !verdict.Approved {
+			slog.Warn("• Tool call is denied by the approval hook", "tool", tool.Tool.Name, "instance", tool.client.instance, "reason", verdict.Reason)
+			message := "The request was denied by the approval hook and was not sent to QueryPie."
+			if verdict.Reason != "" {
+				message += " Reason: " + verdict.Reason
+			}
+			return mcp.NewToolResultError(message), nil
+		}
+
+		slog.Info("• Tool call is approved by the approval hook", "tool", tool.Tool.Name, "instance", tool.client.instance)
+		return next(ctx, request)
+	}
+}
+
+// ask returns the verdict of the hook, or the default verdict if the hook fails.
+func (a *approver) ask(ctx context.Context, approval approvalRequest) approvalVerdict {
+	payload, err := json.Marshal(approval)
+	if err != nil {
+		return a.fallback(fmt.Errorf("failed to marshal approval request: %w", err))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.config.Timeout)
+	defer cancel()
+
+	var verdict *approvalVerdict
+	if a.config.Command != "" {
+		verdict, err = a.askCommand(ctx, payload)
+	} else {
+		verdict, err = a.askURL(ctx, payload)
+	}
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("no verdict within %s", a.config.Timeout)
+		}
+		return a.fallback(err)
+	}
+	return *verdict
+}
+
+func (a *approver) fallback(err error) approvalVerdict {
+	slog.Warn("• Approval hook failed", "error", err, "defaultDeny", a.config.DefaultDeny)
+	if a.config.DefaultDeny {
+		return approvalVerdict{Approved: false, Reason: fmt.Sprintf("approval hook failed: %v", err)}
+	}
+	return approvalVerdict{Approved: true}
+}
+
+// askCommand runs the command with the request on stdin.
+// Exit code 0 approves the call if stdout is empty, or else stdout must be a verdict. Any other exit code denies it.
+func (a *approver) askCommand(ctx context.Context, payload []byte) (*approvalVerdict, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := shellCommand(ctx, a.config.Command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		reason := strings.TrimSpace(stderr.String())
+		if reason == "" {
+			reason = strings.TrimSpace(stdout.String())
+		}
+		if reason == "" {
+			reason = fmt.Sprintf("approval command exited with code %d", exitErr.ExitCode())
+		}
+		return &approvalVerdict{Approved: false, Reason: reason}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to run approval command: %w", err)
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return &approvalVerdict{Approved: true}, nil
+	}
+	verdict, err := parseVerdict(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("malformed approval command output: %w", err)
+	}
+	return verdict, nil
+}
+
+// askURL POSTs the request to the approval service, which must answer 2xx with a verdict.
+func (a *approver) askURL(ctx context.Context, payload []byte) (*approvalVerdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create approval request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send approval request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("approval service responded with %s", resp.Status)
+	}
+
+	verdict, err := parseVerdict(body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed approval response: %w", err)
+	}
+	return verdict, nil
+}
+
+// parseVerdict reads a verdict, which must say whether the call is approved.
+func parseVerdict(data []byte) (*approvalVerdict, error) {
+	var verdict struct {
+		Approved *bool  `json:"approved"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.Unmarshal(data, &verdict); err != nil {
+		return nil, err
+	}
+	if verdict.Approved == nil {
+		return nil, errors.New(`no boolean "approved"`)
+	}
+	return &approvalVerdict{Approved: *verdict.Approved, Reason: verdict.Reason}, nil
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"net/http"
+	"strings"
 )
 
 // authKey is a custom context key for storing the auth token.
@@ -13,7 +14,23 @@ func withAuthKey(ctx context.Context, auth string) context.Context {
 	return context.WithValue(ctx, authKey{}, auth)
 }
 
+// querypieAPIKeyHeader carries the client's QueryPie API key when Authorization is used to authenticate to this server.
+const querypieAPIKeyHeader = "X-QueryPie-API-Key"
+
 // authFromRequest extracts the auth token from the request headers.
 func authFromRequest(ctx context.Context, r *http.Request) context.Context {
+	if apiKey := r.Header.Get(querypieAPIKeyHeader); apiKey != "" {
+		return withAuthKey(ctx, apiKey)
+	}
 	return withAuthKey(ctx, r.Header.Get("Authorization"))
 }
+
+// apiKeyFromContext returns the QueryPie API key the client sent with the request, if any.
+func apiKeyFromContext(ctx context.Context) string {
+	auth, _ := ctx.Value(authKey{}).(string)
+	auth = strings.TrimSpace(auth)
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return auth
+}
@@ -1,73 +1,150 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/querypie/querypie-mcp-server/internal/consts"
+	"github.com/querypie/querypie-mcp-server/openapis"
 )
 
-const CacheTtl = time.Hour * 12
+const (
+	CacheTtl = time.Hour * 12
 
-var ErrCacheFileOutdated = fmt.Errorf("cache file is outdated")
+	cacheFileName     = "openapi.yaml"
+	checksumExtension = ".sha256"
 
-func loadCachedOpenAPI(version Version) ([]byte, error) {
-	cacheDir := filepath.Join(os.TempDir(), ".mcp-querypie", version.String())
-	os.MkdirAll(cacheDir, 0755)
-	cacheFile := filepath.Join(cacheDir, "openapi.yaml")
+	repositoryURL       = "https://github.com/querypie/querypie-mcp-server"
+	specDownloadTimeout = 30 * time.Second
+	maxSpecSize         = 32 << 20 // far larger than any QueryPie specification
+)
+
+var errCacheCorrupted = errors.New("the cached specification does not match its checksum")
 
-	if fileInfo, err := os.Stat(cacheFile); os.IsNotExist(err) {
-		return nil, fmt.Errorf("openapi.yaml file does not exist in cache: %w", err)
-	} else if fileInfo.ModTime().Before(time.Now().Add(-CacheTtl)) {
-		return nil, ErrCacheFileOutdated
+// DefaultCacheDir is where downloaded specifications are cached: the user cache directory,
+// such as $XDG_CACHE_HOME/querypie-mcp-server or ~/.cache/querypie-mcp-server, or else the temporary directory.
+func DefaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "querypie-mcp-server")
 	}
+	return filepath.Join(os.TempDir(), ".mcp-querypie")
+}
 
-	return os.ReadFile(cacheFile)
+// cacheDir is where the specification of the version is cached. Each named instance has its own.
+func cacheDir(root string, instance string, version Version) string {
+	return filepath.Join(root, instance, version.String())
 }
 
-func writeOpenAPIToCache(version Version, spec []byte) error {
-	cacheDir := filepath.Join(os.TempDir(), ".mcp-querypie", version.String())
-	os.MkdirAll(cacheDir, 0755)
-	cacheFile := filepath.Join(cacheDir, "openapi.yaml")
-	return os.WriteFile(cacheFile, spec, 0644)
+// loadCachedOpenAPI returns the cached specification once its checksum is verified,
+// and whether it is older than CacheTtl.
+func loadCachedOpenAPI(dir string) ([]byte, bool, error) {
+	cacheFile := filepath.Join(dir, cacheFileName)
+	fileInfo, err := os.Stat(cacheFile)
+	if err != nil {
+		return nil, false, err
+	}
+	spec, err := os.ReadFile(cacheFile)
+	if err != nil {
+		return nil, false, err
+	}
+
+	checksum, err := os.ReadFile(cacheFile + checksumExtension)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read the checksum of the cached specification: %v", err)
+	}
+	expected, _, _ := strings.Cut(strings.TrimSpace(string(checksum)), " ")
+	actual := sha256.Sum256(spec)
+	if !strings.EqualFold(expected, hex.EncodeToString(actual[:])) {
+		return nil, false, errCacheCorrupted
+	}
+
+	return spec, fileInfo.ModTime().Before(time.Now().Add(-CacheTtl)), nil
 }
 
-func downloadOpenAPIFile(version Version, depth int) ([]byte, error) {
-	repositoryURL := "https://github.com/querypie/querypie-mcp-server"
-	filename := fmt.Sprintf("%s-openapi.yaml", strings.ReplaceAll(version.String(), ".", "-"))
+// writeOpenAPIToCache caches the specification with its SHA-256 checksum, in the format of sha256sum.
+// Each file is replaced atomically, but not both together: if the checksum is not written after the
+// specification, or is read in between, it does not match and the cached specification is downloaded again.
+func writeOpenAPIToCache(dir string, spec []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	cacheFile := filepath.Join(dir, cacheFileName)
+	if err := writeFileAtomic(cacheFile, spec); err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(spec)
+	return writeFileAtomic(cacheFile+checksumExtension, []byte(hex.EncodeToString(checksum[:])+"  "+cacheFileName+"\n"))
+}
 
-	var openapiURL string
-	if consts.Version == "0.0.0" {
-		openapiURL = fmt.Sprintf("%s/releases/latest/download/%s", repositoryURL, filename)
-	} else {
-		openapiURL = fmt.Sprintf("%s/releases/download/v%s/%s", repositoryURL, consts.Version, filename)
+// writeFileAtomic writes the file to a temporary file of the same directory, and renames it over the file.
+func writeFileAtomic(filename string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(file.Name()) // fails once renamed
 
-	response, err := http.Get(openapiURL)
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// downloadOpenAPIFile downloads the specification of the version from the latest GitHub release,
+// as the release of this build only has the specifications already bundled in it.
+func downloadOpenAPIFile(ctx context.Context, version Version) ([]byte, error) {
+	openapiURL := fmt.Sprintf("%s/releases/latest/download/%s", repositoryURL, openapis.Filename(version.String()))
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, openapiURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get openapi.yaml from %s: %w", openapiURL, err)
+	}
+	client := &http.Client{Timeout: specDownloadTimeout}
+	response, err := client.Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get openapi.yaml from %s: %w", openapiURL, err)
 	}
 	defer response.Body.Close()
 
-	spec, err := io.ReadAll(response.Body)
+	spec, err := readSpecBody(response.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read openapi.yaml from %s: %w", openapiURL, err)
 	}
 
 	if response.StatusCode != http.StatusOK {
-		if response.StatusCode == http.StatusNotFound && depth < 1 {
-			slog.Warn("• OpenAPI specification not found in the release. Fallback to v10.2.0")
-			return downloadOpenAPIFile(Version{"10", "2", "0"}, depth+1)
-		}
-
 		return nil, fmt.Errorf("failed to get openapi.yaml from %s: %s", openapiURL, response.Status)
 	}
 
 	return spec, nil
 }
+
+// readSpecBody reads a downloaded specification, up to maxSpecSize.
+func readSpecBody(body io.Reader) ([]byte, error) {
+	spec, err := io.ReadAll(io.LimitReader(body, maxSpecSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(spec) > maxSpecSize {
+		return nil, fmt.Errorf("the specification is larger than %d MiB", maxSpecSize>>20)
+	}
+	return spec, nil
+}
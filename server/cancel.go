@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	DefaultToolTimeout = 2 * time.Minute
+
+	methodCancelled = "notifications/cancelled"
+	// requestIDArgument carries the JSON-RPC ID of a call from the hook to the handler. It never reaches QueryPie.
+	requestIDArgument = "\x00requestID"
+	stdioSessionID    = "stdio" // the session ID mcp-go gives the only stdio client
+)
+
+// ToolTimeouts limits how long the request of a tool to QueryPie may take.
+type ToolTimeouts struct {
+	Default time.Duration            // for tools not in Tools. 0 means no limit
+	Tools   map[string]time.Duration // by tool name
+}
+
+// errCancelledByClient is the cause of calls cancelled with notifications/cancelled.
+var errCancelledByClient = errors.New("cancelled by the client")
+
+type callKey struct {
+	session string
+	id      string
+}
+
+// cancellations lets clients cancel their running calls with notifications/cancelled.
+type cancellations struct {
+	mu    sync.Mutex
+	calls map[callKey]context.CancelCauseFunc
+}
+
+func newCancellations() *cancellations {
+	return &cancellations{calls: make(map[callKey]context.CancelCauseFunc)}
+}
+
+// addHooks passes the request ID of each call to the middleware, and handles the cancel notifications.
+func (c *cancellations) addHooks(hooks *server.Hooks) {
+	hooks.AddBeforeCallTool(func(ctx context.Context, id any, message *mcp.CallToolRequest) {
+		// the handler gets a copy of the request, but its arguments are the same map
+		if message.Params.Arguments == nil {
+			message.Params.Arguments = make(map[string]interface{})
+		}
+		message.Params.Arguments[requestIDArgument] = id
+	})
+}
+
+func (c *cancellations) handleNotification(ctx context.Context, notification mcp.JSONRPCNotification) {
+	session := server.ClientSessionFromContext(ctx)
+	if session == nil {
+		return
+	}
+	reason, _ := notification.Params.AdditionalFields["reason"].(string)
+	c.cancel(session.SessionID(), notification.Params.AdditionalFields["requestId"], reason)
+}
+
+func (c *cancellations) cancel(session string, id any, reason string) {
+	if id == nil {
+		return
+	}
+	c.mu.Lock()
+	cancel, ok := c.calls[callKey{session: session, id: fmt.Sprint(id)}]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	slog.Info("• Tool call is cancelled by the client", "session", session, "id", id, "reason", reason)
+	if reason != "" {
+		cancel(fmt.Errorf("%w: %s", errCancelledByClient, reason))
+	} else {
+		cancel(errCancelledByClient)
+	}
+}
+
+// middleware makes the call cancellable by its client, and reports calls that did not complete.
+func (c *cancellations) middleware(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		id, hasID := request.Params.Arguments[requestIDArgument]
+		delete(request.Params.Arguments, requestIDArgument)
+
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		if session := server.ClientSessionFromContext(ctx); session != nil && hasID && id != nil {
+			key := callKey{session: session.SessionID(), id: fmt.Sprint(id)}
+			c.mu.Lock()
+			c.calls[key] = cancel
+			c.mu.Unlock()
+			defer func() {
+				c.mu.Lock()
+				delete(c.calls, key)
+				c.mu.Unlock()
+			}()
+		}
+
+		result, err := next(ctx, request)
+		if ctx.Err() != nil && (err != nil || result == nil) {
+			return newIncompleteResult(fmt.Sprintf("The call was cancelled (%s) before it completed.", cancelReason(context.Cause(ctx)))), nil
+		}
+		return result, err
+	}
+}
+
+func cancelReason(cause error) string {
+	switch {
+	case errors.Is(cause, errCancelledByClient):
+		return cause.Error()
+	case errors.Is(cause, context.Canceled):
+		return "the client disconnected or the server is shutting down"
+	case errors.Is(cause, context.DeadlineExceeded):
+		return "the tool timed out"
+	default:
+		return cause.Error()
+	}
+}
+
+// timeoutMiddleware limits how long the request to QueryPie may take.
+func timeoutMiddleware(timeouts ToolTimeouts) toolMiddleware {
+	return func(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+		timeout, ok := timeouts.Tools[tool.Tool.Name]
+		if !ok {
+			timeout = timeouts.Default
+			if tool.waits {
+				timeout = jobWaitTimeout
+			}
+		}
+		if timeout <= 0 {
+			return next
+		}
+		return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			result, err := next(ctx, request)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && (err != nil || result == nil) {
+				return newIncompleteResult(fmt.Sprintf("The call timed out after %s before it completed.", timeout)), nil
+			}
+			return result, err
+		}
+	}
+}
+
+// newIncompleteResult tells the model that the request did not complete. A mutating request may still
+// have been carried out by QueryPie, so it must be checked before the call is retried.
+func newIncompleteResult(message string) *mcp.CallToolResult {
+	return mcp.NewToolResultError(message + " QueryPie may or may not have processed the request. Check its state before retrying.")
+}
+
+// filterStdin handles the cancel notifications of a stdio client as soon as they arrive.
+// mcp-go reads stdin only between calls, so they would otherwise wait for the call they cancel.
+func (c *cancellations) filterStdin(in io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(in)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 && !c.handleStdioLine(line) {
+				if _, err := pw.Write(line); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// handleStdioLine cancels the call if the line is a cancel notification, and reports whether it was one.
+func (c *cancellations) handleStdioLine(line []byte) bool {
+	if !bytes.Contains(line, []byte(methodCancelled)) {
+		return false
+	}
+	var notification struct {
+		Method string `json:"method"`
+		Params struct {
+			RequestID any    `json:"requestId"`
+			Reason    string `json:"reason"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || notification.Method != methodCancelled {
+		return false
+	}
+	c.cancel(stdioSessionID, notification.Params.RequestID, notification.Params.Reason)
+	return true
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const probeTimeout = 10 * time.Second
+
+// keyCheckPath is a cheap authenticated endpoint. QueryPie has no endpoint describing the token itself,
+// so a 401 here is the only reliable sign of a bad token.
+const keyCheckPath = "/api/external/v2/security"
+
+// apiArea is a group of QueryPie APIs that is granted to a token as a whole.
+type apiArea struct {
+	name     string
+	probe    string     // a representative read endpoint
+	query    url.Values // keeps the probe response small
+	prefixes []string   // paths of the tools in the area
+}
+
+var apiAreas = []apiArea{
+	{
+		name:  "DAC",
+		probe: "/api/external/v2/dac/connections",
+		query: url.Values{"pageSize": {"1"}},
+		prefixes: []string{
+			"/api/external/v2/dac/",
+			"/api/external/v2/privileges",
+			"/api/external/v2/policies/",
+			"/api/external/v2/ledger-policy-tables",
+			"/api/external/v2/ledger-table-polices",
+			"/api/external/v2/jobs/",
+			"/api/external/connections",
+			"/api/external/access-controls",
+			"/api/external/policies",
+			"/api/external/masking-patterns",
+			"/api/external/proxies",
+			"/api/external/cloud-providers",
+		},
+	},
+	{
+		name:  "SAC",
+		probe: "/api/external/v2/sac/servers",
+		query: url.Values{"pageSize": {"1"}},
+		prefixes: []string{
+			"/api/external/v2/sac/",
+		},
+	},
+	{
+		name:  "audit",
+		probe: "/api/external/v2/activity-logs",
+		query: url.Values{"count": {"1"}},
+		prefixes: []string{
+			"/api/external/v2/activity-logs",
+			"/api/external/v2/admin-role-history",
+			"/api/external/v2/account-lock-history",
+			"/api/external/v2/audit-log-export",
+			"/api/external/v2/db-access-control-logs",
+			"/api/external/v2/db-access-history",
+			"/api/external/v2/dml-snapshots",
+			"/api/external/v2/query-audit",
+			"/api/external/v2/user-access-history",
+			"/api/external/audit-logs",
+			"/api/external/connection-auth-logs",
+			"/api/external/system-auth-logs",
+		},
+	},
+	{
+		name:  "workflows",
+		probe: "/api/external/v2/workflows",
+		query: url.Values{"pageSize": {"1"}},
+		prefixes: []string{
+			"/api/external/v2/workflows",
+			"/api/external/v2/approval-rules",
+			"/api/external/v2/ledger-approval-rules",
+			"/api/external/workflow/",
+			"/api/external/approvals",
+			"/api/external/approval-rules",
+			"/api/external/access-approvals",
+		},
+	},
+}
+
+// contains reports whether the tool of the path belongs to the area.
+func (a apiArea) contains(path string) bool {
+	for _, prefix := range a.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilities are the API areas the server's own key can use.
+type capabilities struct {
+	unavailable map[string]bool // keyed by area name
+}
+
+// verifyAPIKey checks the key against QueryPie, and fails if it is rejected.
+func verifyAPIKey(ctx context.Context, client *querypieClient, keys apiKeySource, name string) (string, error) {
+	apiKey, err := keys.APIKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	status, err := client.probe(ctx, apiKey, keyCheckPath, nil)
+	switch {
+	case err != nil:
+		slog.Warn(fmt.Sprintf("   • Could not verify the %s", name), "error", err)
+	case status == http.StatusUnauthorized:
+		return "", fmt.Errorf("%s %s is rejected by %s. please check the API key", name, maskSecret(apiKey), client.baseURL.Redacted())
+	case status < 300 || status == http.StatusForbidden:
+		// a forbidden key is still a valid one. it is just not allowed to read the security settings
+		slog.Info(fmt.Sprintf("   ✔ %s is valid", name), "key", maskSecret(apiKey))
+	default:
+		slog.Warn(fmt.Sprintf("   • Could not verify the %s", name), "status", status)
+	}
+	return apiKey, nil
+}
+
+// detectCapabilities verifies the server's key and probes each API area that has tools.
+// Areas that answer with anything but 401 or 403 are assumed to be available.
+func detectCapabilities(ctx context.Context, client *querypieClient, tools []operationTool) (*capabilities, error) {
+	apiKey, err := verifyAPIKey(ctx, client, client.readKeys, "QueryPie API key")
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &capabilities{unavailable: make(map[string]bool)}
+	for _, area := range apiAreas {
+		if !hasToolIn(tools, area) {
+			continue
+		}
+		status, err := client.probe(ctx, apiKey, area.probe, area.query)
+		switch {
+		case err != nil:
+			slog.Warn(fmt.Sprintf("   • Could not detect access to %s APIs. Keeping its tools", area.name), "error", err)
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			caps.unavailable[area.name] = true
+			slog.Info(fmt.Sprintf("   • QueryPie API key cannot use %s APIs. Skipping its tools", area.name))
+		default:
+			slog.Info(fmt.Sprintf("   ✔ QueryPie API key can use %s APIs", area.name))
+		}
+	}
+	return caps, nil
+}
+
+func hasToolIn(tools []operationTool, area apiArea) bool {
+	for _, tool := range tools {
+		if area.contains(tool.operation.pathKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter drops the tools of unavailable areas.
+func (c *capabilities) filter(tools []operationTool) []operationTool {
+	if c == nil || len(c.unavailable) == 0 {
+		return tools
+	}
+
+	var filtered []operationTool
+	for _, tool := range tools {
+		if area, ok := areaOf(tool.operation.pathKey); ok && c.unavailable[area.name] {
+			continue
+		}
+		filtered = append(filtered, tool)
+	}
+	return filtered
+}
+
+func areaOf(path string) (apiArea, bool) {
+	for _, area := range apiAreas {
+		if area.contains(path) {
+			return area, true
+		}
+	}
+	return apiArea{}, false
+}
+
+// probe sends an authenticated GET request and returns the response status.
+func (c *querypieClient) probe(ctx context.Context, apiKey string, path string, query url.Values) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode >= 500 {
+		return resp.StatusCode, errors.New(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// querypieClient sends tool calls to the QueryPie API.
+type querypieClient struct {
+	instance   string       // name of the QueryPie instance. empty if it is the only one
+	readKeys   apiKeySource // the server's own key. nil if clients must send theirs
+	writeKeys  apiKeySource // the server's key for mutating tools. the same as readKeys unless a separate write key is set
+	baseURL    *url.URL
+	httpClient *http.Client
+}
+
+func newQuerypieClient(readKeys, writeKeys apiKeySource, querypieURL string) (*querypieClient, error) {
+	baseURL, err := url.Parse(querypieURL)
+	if err != nil {
+		return nil, fmt.Errorf("malformed querypie URL: %w", err)
+	}
+
+	return &querypieClient{
+		readKeys:   readKeys,
+		writeKeys:  writeKeys,
+		baseURL:    baseURL,
+		httpClient: http.DefaultClient,
+	}, nil
+}
+
+// apiKeyFor returns the API key of the client that made the call, falling back to the server's key
+// for reading or for mutating. It returns an empty key if neither is available.
+func (c *querypieClient) apiKeyFor(ctx context.Context, mutating bool) (string, error) {
+	// a client's key is for a single QueryPie, so named instances always use their own
+	if apiKey := apiKeyFromContext(ctx); apiKey != "" && c.instance == "" {
+		return apiKey, nil
+	}
+	keys := c.readKeys
+	if mutating {
+		keys = c.writeKeys
+	}
+	if keys == nil {
+		return "", nil
+	}
+	return keys.APIKey(ctx)
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// shellCommand runs a user supplied command line through the platform shell.
+// Once ctx is done, its output is abandoned shortly after even if child processes keep it open.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.WaitDelay = time.Second
+	return cmd
+}
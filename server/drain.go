@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const DefaultDrainTimeout = 10 * time.Second
+
+// drainer tracks the running tool calls, so the server can let them finish before shutting down.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	running  int
+	idle     chan struct{} // closed when no call is running during draining
+}
+
+func newDrainer() *drainer {
+	return &drainer{}
+}
+
+// middleware counts the running calls, and rejects new calls once draining has started.
+func (d *drainer) middleware(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		d.mu.Lock()
+		if d.draining {
+			d.mu.Unlock()
+			return mcp.NewToolResultError("The server is shutting down. Retry the call after it restarts."), nil
+		}
+		d.running++
+		d.mu.Unlock()
+
+		defer d.done()
+		return next(ctx, request)
+	}
+}
+
+// isDraining reports whether the server is shutting down.
+func (d *drainer) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+func (d *drainer) done() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running--
+	if d.draining && d.running == 0 {
+		close(d.idle)
+	}
+}
+
+// drain rejects new calls and waits until the running ones have finished or ctx is done.
+// It returns the number of calls still running.
+func (d *drainer) drain(ctx context.Context) int {
+	d.mu.Lock()
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+		if d.running == 0 {
+			close(d.idle)
+		}
+	}
+	idle := d.idle
+	d.mu.Unlock()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	dryRunArgument    = "_dryRun"
+	dryRunDescription = "If true, the request is not sent to QueryPie. The rendered HTTP request is returned instead."
+)
+
+type dryRunKey struct{}
+
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// dryRunFromContext reports whether the current tool call must not be sent to QueryPie.
+func dryRunFromContext(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// dryRunMiddleware marks the call as a dry run if it is enabled globally or by the _dryRun argument.
+func dryRunMiddleware(global bool) toolMiddleware {
+	return func(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+		return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			if global || isTruthy(request.Params.Arguments[dryRunArgument]) {
+				slog.Info("• Tool call is a dry run. The request is not sent to QueryPie", "tool", tool.Tool.Name, "instance", tool.client.instance)
+				ctx = withDryRun(ctx)
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+func isTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+// renderedRequest is an HTTP request to QueryPie rendered for humans, with credentials masked.
+type renderedRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	Curl    string            `json:"curl"`
+}
+
+// newDryRunResult renders the request that would have been sent.
+func newDryRunResult(req *http.Request, body []byte) (*mcp.CallToolResult, error) {
+	var out strings.Builder
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(renderRequest(req, body)); err != nil {
+		return nil, fmt.Errorf("failed to render dry run request: %w", err)
+	}
+
+	result := mcp.NewToolResultText(strings.TrimSpace(out.String()))
+	result.Meta = map[string]interface{}{
+		"dryRun": true,
+	}
+	return result, nil
+}
+
+func renderRequest(req *http.Request, body []byte) renderedRequest {
+	rendered := renderedRequest{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Headers: make(map[string]string),
+		Body:    body,
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	curl := []string{"curl", "-X", req.Method, shellQuote(req.URL.String())}
+	for _, name := range names {
+		value := strings.Join(req.Header.Values(name), ", ")
+		if name == "Authorization" {
+			rendered.Headers[name] = maskAuthorization(value)
+			curl = append(curl, "-H", `"Authorization: Bearer ${QUERYPIE_API_KEY}"`)
+			continue
+		}
+		rendered.Headers[name] = value
+		curl = append(curl, "-H", shellQuote(name+": "+value))
+	}
+	if len(body) > 0 {
+		curl = append(curl, "--data", shellQuote(string(body)))
+	}
+	rendered.Curl = strings.Join(curl, " ")
+
+	return rendered
+}
+
+func maskAuthorization(value string) string {
+	scheme, token, ok := strings.Cut(value, " ")
+	if !ok {
+		return maskSecret(value)
+	}
+	return scheme + " " + maskSecret(token)
+}
+
+// maskSecret keeps only the first few characters of a secret.
+func maskSecret(secret string) string {
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return secret[:4] + "****"
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
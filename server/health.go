@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthPath     = "/healthz"
+	readyPath      = "/readyz"
+	debugToolsPath = "/debug/tools"
+
+	readyCheckTimeout = 5 * time.Second
+	readyCheckTTL     = 5 * time.Second // how long the result of the QueryPie check is reused, so probes do not flood QueryPie
+)
+
+// HealthConfig selects the health and introspection endpoints of the network transports.
+type HealthConfig struct {
+	Enabled     bool   // serve /healthz and /readyz
+	DebugTools  bool   // serve /debug/tools. with MCP, only if the admin token is set
+	AdminListen string // address of a separate listener for the endpoints. they are served with MCP if empty
+}
+
+func (c HealthConfig) enabled() bool {
+	return c.Enabled || c.DebugTools
+}
+
+// health serves the liveness, readiness and tool listing endpoints.
+type health struct {
+	config        HealthConfig
+	instances     []*instance
+	tools         []operationTool
+	drainer       *drainer
+	checkQueryPie bool   // false in a dry run, which must not reach QueryPie
+	adminToken    string // required for /debug/tools if set
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	checkErr  error
+}
+
+func (s *Server) newHealth(instances []*instance, tools []operationTool, drainer *drainer) *health {
+	if !s.health.enabled() {
+		return nil
+	}
+	return &health{
+		config:        s.health,
+		instances:     instances,
+		tools:         tools,
+		drainer:       drainer,
+		checkQueryPie: !s.dryRun,
+		adminToken:    s.writeWindow.AdminToken,
+	}
+}
+
+func (h *health) register(mux *http.ServeMux) {
+	if h.config.Enabled {
+		mux.HandleFunc(healthPath, h.serveHealth)
+		mux.HandleFunc(readyPath, h.serveReady)
+	}
+	if h.config.DebugTools {
+		mux.HandleFunc(debugToolsPath, h.serveDebugTools)
+	}
+}
+
+// serveHealth reports that the process is alive and serving requests.
+func (h *health) serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// serveReady reports whether the server can serve tool calls: its tools are registered,
+// it is not shutting down and every QueryPie instance is reachable.
+func (h *health) serveReady(w http.ResponseWriter, r *http.Request) {
+	reason := ""
+	switch {
+	case len(h.tools) == 0:
+		reason = "no tools are registered"
+	case h.drainer.isDraining():
+		reason = "the server is shutting down"
+	default:
+		if err := h.checkInstances(r.Context()); err != nil {
+			reason = err.Error()
+		}
+	}
+
+	if reason != "" {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "reason": reason})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// checkInstances gets the version of each QueryPie instance, reusing the last result for a while.
+func (h *health) checkInstances(ctx context.Context) error {
+	if !h.checkQueryPie {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < readyCheckTTL {
+		return h.checkErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+	h.checkErr = nil
+	for _, instance := range h.instances {
+		if _, err := GetVersion(ctx, instance.url); err != nil {
+			if instance.name != "" {
+				err = fmt.Errorf("instance %s: %w", instance.name, err)
+			}
+			slog.Warn("• QueryPie is not reachable", "error", err)
+			h.checkErr = err
+			break
+		}
+	}
+	h.checkedAt = time.Now()
+	return h.checkErr
+}
+
+type toolInfo struct {
+	Name            string `json:"name"`
+	Instance        string `json:"instance,omitempty"`
+	Method          string `json:"method"`
+	Path            string `json:"path"`
+	Mutating        bool   `json:"mutating"`
+	QueryPieURL     string `json:"querypieUrl"`
+	QueryPieVersion string `json:"querypieVersion"`
+	Spec            string `json:"spec"` // where the OpenAPI specification of the tool is loaded from
+}
+
+// serveDebugTools lists the registered tools and the QueryPie operations they come from.
+func (h *health) serveDebugTools(w http.ResponseWriter, r *http.Request) {
+	if h.adminToken != "" && !adminAuthorized(r, h.adminToken) {
+		slog.Warn("• Unauthorized request to the tool listing endpoint", "remote", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	instances := make(map[string]*instance, len(h.instances))
+	for _, instance := range h.instances {
+		instances[instance.name] = instance
+	}
+
+	tools := make([]toolInfo, 0, len(h.tools))
+	for _, tool := range h.tools {
+		info := toolInfo{
+			Name:     tool.Tool.Name,
+			Instance: tool.client.instance,
+			Method:   tool.operation.method,
+			Path:     tool.operation.pathKey,
+			Mutating: tool.mutating(),
+		}
+		if instance := instances[tool.client.instance]; instance != nil {
+			info.QueryPieURL = instance.url
+			info.QueryPieVersion = instance.version
+			info.Spec = instance.specSource
+		}
+		tools = append(tools, info)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tools": tools})
+}
+
+// adminAuthorized reports whether the request carries the admin token as its bearer token.
+func adminAuthorized(r *http.Request, adminToken string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const connectionCloseTimeout = time.Second
+
+// serveHTTP serves the MCP server over a network transport until ctx is done.
+func (s *Server) serveHTTP(ctx context.Context, srv *server.MCPServer, window *writeWindow, drainer *drainer, health *health, ownKey bool) error {
+	authenticator, err := newInboundAuthenticator(s.inboundAuth)
+	if err != nil {
+		return fmt.Errorf("failed to set up client authentication: %w", err)
+	}
+	if authenticator != nil {
+		slog.Info("   ✔ MCP clients must authenticate with a bearer token")
+		if authenticator.oauth != nil {
+			slog.Info("   ✔ OAuth access tokens are accepted", "authorizationServer", s.inboundAuth.AuthorizationServer, "resource", s.inboundAuth.Resource)
+		}
+	} else {
+		slog.Warn("   • MCP clients are not authenticated. Anyone who can reach the server can use it")
+	}
+	if !ownKey {
+		slog.Info("   • QUERYPIE_API_KEY is not set. Each client must send its own QueryPie API key")
+	}
+
+	// requests are served until the running tool calls have drained, not cancelled by the signal
+	serveCtx, cancelServe := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelServe()
+
+	mux := http.NewServeMux()
+	httpSrv := &http.Server{Handler: mux}
+	var adminTLSConfig *tls.Config
+	if s.tls.enabled() {
+		files, err := newTLSFiles(s.tls)
+		if err != nil {
+			return err
+		}
+		go files.watch(serveCtx)
+		httpSrv.TLSConfig = files.tlsConfig(true)
+		adminTLSConfig = files.tlsConfig(false)
+		slog.Info("   ✔ TLS is enabled", "cert", s.tls.CertFile)
+		if s.tls.ClientCAFile != "" {
+			slog.Info("   ✔ MCP clients must present a certificate signed by the client CA", "clientCA", s.tls.ClientCAFile)
+		}
+	}
+
+	// the transport's own handler, and how it shuts down with its sessions
+	var transport http.Handler
+	var pattern string
+	var shutdown func(ctx context.Context) error
+	switch s.transport {
+	case "sse":
+		sseSrv := server.NewSSEServer(srv,
+			server.WithHTTPServer(httpSrv),
+			server.WithSSEContextFunc(authFromRequest),
+			server.WithBasePath(s.basePath),
+		)
+		// the message endpoint is resolved per connection, as it depends on the proxy in front
+		transport, pattern, shutdown = s.publicAddress().wrapSSE(sseSrv), s.basePath+"/", sseSrv.Shutdown
+	case "http":
+		allowedOrigins := s.allowedOrigins
+		if s.publicURL != nil {
+			allowedOrigins = append([]string{s.publicURL.String()}, allowedOrigins...)
+		}
+		streamable := newStreamableServer(serveCtx, srv, authFromRequest, allowedOrigins)
+		transport, pattern = streamable, s.basePath+streamableEndpoint
+		shutdown = func(ctx context.Context) error {
+			streamable.close()
+			return httpSrv.Shutdown(ctx)
+		}
+	}
+	if authenticator != nil {
+		transport = authenticator.wrap(transport)
+	}
+	mux.Handle(pattern, transport)
+
+	if authenticator != nil && authenticator.oauth != nil {
+		mux.Handle(authenticator.oauth.metadataPath(), authenticator.oauth)
+	}
+	if window != nil && s.writeWindow.AdminToken != "" {
+		mux.Handle(s.basePath+"/admin/write-window", window)
+	}
+
+	// the health endpoints may be kept off the MCP listener, so only the cluster can reach them
+	var adminSrv *http.Server
+	if health != nil {
+		if s.health.AdminListen == "" {
+			if s.health.DebugTools && s.writeWindow.AdminToken == "" {
+				return errors.New("/debug/tools is served with MCP only with an admin token")
+			}
+			health.register(mux)
+		} else {
+			adminMux := http.NewServeMux()
+			health.register(adminMux)
+			adminListener, err := listenOn(s.health.AdminListen, s.socketMode)
+			if err != nil {
+				return err
+			}
+			// the admin token is sent to it too, so it is served with the same certificate,
+			// but without requiring client certificates, which probes such as the kubelet's do not have
+			adminSrv = &http.Server{Handler: adminMux, TLSConfig: adminTLSConfig}
+			go func() {
+				var err error
+				if adminSrv.TLSConfig != nil {
+					err = adminSrv.ServeTLS(adminListener, "", "")
+				} else {
+					err = adminSrv.Serve(adminListener)
+				}
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("• Admin endpoints stopped", "error", err)
+				}
+			}()
+			slog.Info("   ✔ Admin endpoints are listening on " + s.health.AdminListen)
+		}
+	}
+
+	listener, address, err := s.listen()
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("✔ MCP Server with %s is now listening on %s", s.transport, address))
+	if s.publicURL != nil {
+		slog.Info("   ✔ MCP endpoints are advertised with the public URL " + s.publicURL.String())
+	}
+	if s.basePath != "" {
+		slog.Info("   ✔ MCP endpoints are served under " + s.basePath)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		var err error
+		if httpSrv.TLSConfig != nil {
+			err = httpSrv.ServeTLS(listener, "", "")
+		} else {
+			err = httpSrv.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errChan <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		slog.Info("• Shutting down MCP Server ...")
+		s.drain(drainer)
+		cancelServe()
+
+		// the tool calls are done, so the connections are given only a moment to close
+		ctx, cancel := context.WithTimeout(context.Background(), connectionCloseTimeout)
+		defer cancel()
+		err := shutdown(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			slog.Warn("• Some connections did not close in time. They are closed forcibly")
+			err = httpSrv.Close()
+		}
+		if adminSrv != nil {
+			_ = adminSrv.Close()
+		}
+		slog.Info("• MCP Server is shutdown")
+		return err
+	case err := <-errChan:
+		return err
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const clientInfoIdleTimeout = 24 * time.Hour
+
+// actingUser is who a tool call is made for, sent to QueryPie in a header so its audit logs show more than the API key.
+type actingUser struct {
+	header string
+	value  string
+}
+
+type actingUserKey struct{}
+
+func withActingUser(ctx context.Context, user *actingUser) context.Context {
+	return context.WithValue(ctx, actingUserKey{}, user)
+}
+
+// actingUserFromContext returns who the call is made for, or nil.
+func actingUserFromContext(ctx context.Context) *actingUser {
+	user, _ := ctx.Value(actingUserKey{}).(*actingUser)
+	return user
+}
+
+type clientInfo struct {
+	name     string
+	lastSeen time.Time
+}
+
+// identityAttribution names the user of each tool call, from the authenticated client identity,
+// or else from the clientInfo the MCP client sent when it initialized its session.
+type identityAttribution struct {
+	header string
+
+	mu        sync.Mutex
+	clients   map[string]*clientInfo // keyed by session ID
+	lastPrune time.Time
+}
+
+func newIdentityAttribution(header string) *identityAttribution {
+	if header == "" {
+		return nil
+	}
+	return &identityAttribution{
+		header:  header,
+		clients: make(map[string]*clientInfo),
+	}
+}
+
+// addHooks records the clientInfo of each session.
+func (a *identityAttribution) addHooks(hooks *server.Hooks) {
+	hooks.AddAfterInitialize(func(ctx context.Context, id any, message *mcp.InitializeRequest, result *mcp.InitializeResult) {
+		session := server.ClientSessionFromContext(ctx)
+		if session == nil || message.Params.ClientInfo.Name == "" {
+			return
+		}
+
+		now := time.Now()
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		// Sessions are never unregistered from here, so drop idle ones from time to time
+		if now.Sub(a.lastPrune) > time.Minute {
+			for id, client := range a.clients {
+				if now.Sub(client.lastSeen) > clientInfoIdleTimeout {
+					delete(a.clients, id)
+				}
+			}
+			a.lastPrune = now
+		}
+		a.clients[session.SessionID()] = &clientInfo{name: message.Params.ClientInfo.Name, lastSeen: now}
+	})
+}
+
+// identify returns the name of the user of the call, or an empty string if it is unknown.
+func (a *identityAttribution) identify(ctx context.Context) string {
+	if identity := clientIdentityFromContext(ctx); identity != nil && identity.Subject != "" {
+		return identity.Subject
+	}
+
+	session := server.ClientSessionFromContext(ctx)
+	if session == nil {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	client, ok := a.clients[session.SessionID()]
+	if !ok {
+		return ""
+	}
+	client.lastSeen = time.Now()
+	return client.name
+}
+
+// middleware attributes the call to its user, and records the user in the result metadata.
+func (a *identityAttribution) middleware(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		value := sanitizeHeaderValue(a.identify(ctx))
+		if value == "" {
+			return next(ctx, request)
+		}
+
+		result, err := next(withActingUser(ctx, &actingUser{header: a.header, value: value}), request)
+		if result != nil {
+			if result.Meta == nil {
+				result.Meta = make(map[string]interface{})
+			}
+			result.Meta["actingUser"] = value
+		}
+		return result, err
+	}
+}
+
+// sanitizeHeaderValue drops control characters, which are not allowed in header values.
+func sanitizeHeaderValue(value string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value))
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// InboundAuthConfig configures how MCP clients authenticate to the network transports.
+// A client is accepted if any of the configured methods accepts its bearer token.
+type InboundAuthConfig struct {
+	TokensFile     string // static tokens, one "<token> [name]" per line
+	HMACSecretFile string // shared secret of HS256/HS384/HS512 signed JWTs
+	JWKSFile       string // public keys of RS*/ES* signed JWTs
+	Issuer         string // expected "iss" of JWTs. required with JWKSFile
+	Audience       string // expected "aud" of JWTs. required with HMACSecretFile and JWKSFile
+
+	// OAuth access tokens of an authorization server, whose keys are discovered from its metadata
+	AuthorizationServer string // issuer URL of the authorization server
+	JWKSURL             string // overrides the jwks_uri of the authorization server metadata
+	Resource            string // public URL of this server. tokens must be issued for it, unless Audience is set
+}
+
+func (c InboundAuthConfig) enabled() bool {
+	return c.TokensFile != "" || c.HMACSecretFile != "" || c.JWKSFile != "" || c.AuthorizationServer != ""
+}
+
+// clientIdentity is the authenticated MCP client.
+type clientIdentity struct {
+	Subject string
+	Method  string
+	Scopes  []string
+}
+
+type clientIdentityKey struct{}
+
+func withClientIdentity(ctx context.Context, identity *clientIdentity) context.Context {
+	return context.WithValue(ctx, clientIdentityKey{}, identity)
+}
+
+// clientIdentityFromContext returns the authenticated MCP client, or nil.
+func clientIdentityFromContext(ctx context.Context) *clientIdentity {
+	identity, _ := ctx.Value(clientIdentityKey{}).(*clientIdentity)
+	return identity
+}
+
+type staticToken struct {
+	hash [sha256.Size]byte
+	name string
+}
+
+type inboundAuthenticator struct {
+	tokens []staticToken
+	jwt    *jwtVerifier
+	oauth  *oauthResource
+}
+
+func newInboundAuthenticator(config InboundAuthConfig) (*inboundAuthenticator, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+
+	a := &inboundAuthenticator{}
+
+	if config.TokensFile != "" {
+		tokens, err := loadStaticTokens(config.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	}
+
+	if (config.HMACSecretFile != "" || config.JWKSFile != "") && config.Audience == "" {
+		return nil, errors.New("JWT authentication requires an audience")
+	}
+	if config.JWKSFile != "" && config.Issuer == "" {
+		return nil, errors.New("JWKS authentication requires an issuer")
+	}
+	if config.HMACSecretFile != "" || config.JWKSFile != "" {
+		a.jwt = &jwtVerifier{issuer: config.Issuer, audience: config.Audience}
+	}
+	if config.HMACSecretFile != "" {
+		secret, err := os.ReadFile(config.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HMAC secret file: %w", err)
+		}
+		a.jwt.secret = []byte(strings.TrimSpace(string(secret)))
+		if len(a.jwt.secret) < 32 {
+			return nil, errors.New("HMAC secret must be at least 32 bytes")
+		}
+	}
+	if config.JWKSFile != "" {
+		keys, err := loadJWKSFile(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt.keys = keys.lookup
+	}
+
+	if config.AuthorizationServer != "" {
+		oauth, err := newOAuthResource(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up OAuth: %w", err)
+		}
+		a.oauth = oauth
+	}
+
+	return a, nil
+}
+
+func loadStaticTokens(filename string) ([]staticToken, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	defer file.Close()
+
+	var tokens []staticToken
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		token := staticToken{hash: sha256.Sum256([]byte(fields[0]))}
+		if len(fields) > 1 {
+			token.name = fields[1]
+		} else {
+			token.name = fmt.Sprintf("token-%s", hex.EncodeToString(token.hash[:4]))
+		}
+		tokens = append(tokens, token)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no token in %s", filename)
+	}
+	return tokens, nil
+}
+
+func (a *inboundAuthenticator) authenticate(token string) (*clientIdentity, error) {
+	if token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+			return &clientIdentity{Subject: t.name, Method: "token"}, nil
+		}
+	}
+
+	if strings.Count(token, ".") != 2 {
+		return nil, errors.New("unknown token")
+	}
+
+	err := errors.New("unknown token")
+	if a.jwt != nil {
+		var claims *jwtClaims
+		if claims, err = a.jwt.verify(token); err == nil {
+			return &clientIdentity{Subject: claims.Subject, Method: "jwt", Scopes: claims.Scopes}, nil
+		}
+	}
+	if a.oauth != nil {
+		var claims *jwtClaims
+		if claims, err = a.oauth.verifier.verify(token); err == nil {
+			return &clientIdentity{Subject: claims.Subject, Method: "oauth", Scopes: claims.Scopes}, nil
+		}
+	}
+	return nil, err
+}
+
+// wrap rejects unauthenticated requests with 401 before they reach the MCP transport.
+// The client's Authorization header is consumed here, so it is never forwarded to QueryPie.
+func (a *inboundAuthenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token = strings.TrimSpace(token)
+		identity, err := a.authenticate(token)
+		if err != nil {
+			slog.Warn("• Unauthenticated MCP client is rejected", "remote", r.RemoteAddr, "path", r.URL.Path, "error", err)
+			errorCode := ""
+			if token != "" {
+				errorCode = "invalid_token"
+			}
+			w.Header().Set("WWW-Authenticate", a.challenge(errorCode))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// an OAuth token must grant one of the toolsets
+		if identity.Method == "oauth" && !identity.hasToolset() {
+			slog.Warn("• MCP client without a QueryPie scope is rejected", "remote", r.RemoteAddr, "subject", identity.Subject)
+			w.Header().Set("WWW-Authenticate", a.challenge("insufficient_scope"))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		r = r.Clone(withClientIdentity(r.Context(), identity))
+		r.Header.Del("Authorization")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// challenge is the WWW-Authenticate header of rejected requests. With OAuth, it points clients
+// to the protected resource metadata to discover the authorization server.
+func (a *inboundAuthenticator) challenge(errorCode string) string {
+	challenge := `Bearer realm="mcp-querypie"`
+	if errorCode != "" {
+		challenge += fmt.Sprintf(`, error="%s"`, errorCode)
+	}
+	if errorCode == "insufficient_scope" {
+		challenge += fmt.Sprintf(`, scope="%s %s"`, scopeRead, scopeWrite)
+	}
+	if a.oauth != nil {
+		challenge += fmt.Sprintf(`, resource_metadata="%s"`, a.oauth.metadataURL())
+	}
+	return challenge
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InstanceConfig is a QueryPie deployment served by the server, such as prod, staging or DR.
+type InstanceConfig struct {
+	Name             string        `yaml:"name"`             // prefixes the names of the instance's tools
+	URL              string        `yaml:"url"`              // URL of QueryPie
+	APIKeyEnv        string        `yaml:"apiKeyEnv"`        // environment variable containing the API key
+	APIKeyFile       string        `yaml:"apiKeyFile"`       // file containing the API key, reloaded when it changes
+	APIKeyCommand    string        `yaml:"apiKeyCommand"`    // command printing the API key
+	APIKeyCommandTTL time.Duration `yaml:"apiKeyCommandTTL"` // how long the output of APIKeyCommand is cached
+	Version          string        `yaml:"version"`          // QueryPie version. detected from QueryPie if empty
+	OpenAPI          string        `yaml:"openapi"`          // file or URL of the OpenAPI specification, instead of the one of the version
+}
+
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// LoadInstancesFile reads the instance list of a config file:
+//
+//	instances:
+//	  - name: prod
+//	    url: https://querypie.example.com
+//	    apiKeyEnv: QUERYPIE_PROD_API_KEY
+//	    version: 10.2.8
+func LoadInstancesFile(filename string) ([]InstanceConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config struct {
+		Instances []InstanceConfig `yaml:"instances"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("malformed config file %s: %w", filename, err)
+	}
+	if len(config.Instances) == 0 {
+		return nil, fmt.Errorf("no instance in %s", filename)
+	}
+
+	names := make(map[string]bool)
+	for _, instance := range config.Instances {
+		if !instanceNamePattern.MatchString(instance.Name) {
+			return nil, fmt.Errorf("invalid instance name %q. use letters, digits and '-'", instance.Name)
+		}
+		if names[instance.Name] {
+			return nil, fmt.Errorf("duplicate instance name: %s", instance.Name)
+		}
+		names[instance.Name] = true
+
+		if instance.URL == "" {
+			return nil, fmt.Errorf("instance %s has no url", instance.Name)
+		}
+		sources := 0
+		for _, source := range []string{instance.APIKeyEnv, instance.APIKeyFile, instance.APIKeyCommand} {
+			if source != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return nil, fmt.Errorf("instance %s must have exactly one of apiKeyEnv, apiKeyFile and apiKeyCommand", instance.Name)
+		}
+	}
+	return config.Instances, nil
+}
+
+// instance is a QueryPie deployment whose API is served as tools.
+type instance struct {
+	name             string // prefixes the tool names. empty if it is the only instance
+	url              string
+	version          string       // resolved to the version of QueryPie once the instance is loaded, unless openapi is set
+	openapi          string       // file or URL of the OpenAPI specification. empty to use the one of the version
+	specSource       string       // where the OpenAPI specification is loaded from: embedded, cache, download, or openapi itself
+	readKeys         apiKeySource // nil if clients must send their own key
+	writeKeys        apiKeySource // nil if mutating tools are disabled
+	separateWriteKey bool
+}
+
+// toolName is the name of an operation's tool, prefixed with the name of the instance.
+func (i *instance) toolName(operationID string) string {
+	if i.name == "" {
+		return operationID
+	}
+	return i.name + "_" + operationID
+}
+
+// newInstances returns the instances of the config file, or the only instance of the command line.
+func (s *Server) newInstances(ctx context.Context, versionStr string) ([]*instance, error) {
+	if len(s.instances) == 0 {
+		readKeys, err := s.newAPIKeySource(ctx)
+		if err != nil {
+			return nil, err
+		}
+		writeKeys, err := s.newWriteAPIKeySource(ctx, readKeys)
+		if err != nil {
+			return nil, err
+		}
+		return []*instance{{
+			url:              s.querypieURL,
+			version:          versionStr,
+			openapi:          s.openapi,
+			readKeys:         readKeys,
+			writeKeys:        writeKeys,
+			separateWriteKey: s.separateWriteKey,
+		}}, nil
+	}
+
+	var instances []*instance
+	for _, config := range s.instances {
+		slog.Info(fmt.Sprintf("• Setting up the instance %s", config.Name), "url", config.URL)
+
+		var key string
+		if config.APIKeyEnv != "" {
+			if key = os.Getenv(config.APIKeyEnv); key == "" {
+				return nil, fmt.Errorf("%s of instance %s is not set", config.APIKeyEnv, config.Name)
+			}
+		}
+		keys, err := newAPIKeySource(ctx, key, config.APIKeyFile, config.APIKeyCommand, config.APIKeyCommandTTL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the API key of instance %s: %w", config.Name, err)
+		}
+		if keys == nil {
+			return nil, fmt.Errorf("instance %s has no API key", config.Name)
+		}
+
+		version := config.Version
+		if version == "" {
+			version = versionStr
+		}
+		openapi := config.OpenAPI
+		if openapi == "" {
+			openapi = s.openapi
+		}
+		instances = append(instances, &instance{
+			name:      config.Name,
+			url:       config.URL,
+			version:   version,
+			openapi:   openapi,
+			readKeys:  keys,
+			writeKeys: keys,
+		})
+	}
+	return instances, nil
+}
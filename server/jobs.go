@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	jobToolSuffix          = "_and_wait"
+	jobWaitTimeout         = 30 * time.Minute // unless a --tool-timeout is set for the tool
+	jobPollInitialInterval = 2 * time.Second
+	jobPollMaxInterval     = 15 * time.Second
+)
+
+// jobSpec is an asynchronous QueryPie job: the operation that starts it, and the one that reports its status.
+type jobSpec struct {
+	start  string // operation ID
+	status string // operation ID
+
+	// statusArguments returns the arguments of the status operation, from the call and the response that started the job
+	statusArguments func(arguments, started map[string]interface{}) (map[string]interface{}, bool)
+	// state returns the state of the job in a status response, whether it is finished, and whether it failed
+	state func(status map[string]interface{}) (state string, finished bool, failed bool)
+}
+
+var jobSpecs = []jobSpec{
+	{
+		start:  "v2_run_audit_export_task",
+		status: "v2_get_audit_export_task_details",
+		statusArguments: func(arguments, started map[string]interface{}) (map[string]interface{}, bool) {
+			uuid, ok := started["uuid"].(string)
+			return map[string]interface{}{"taskUuid": uuid}, ok && uuid != ""
+		},
+		state: func(status map[string]interface{}) (string, bool, bool) {
+			state, _ := status["status"].(string)
+			switch state {
+			case "COMPLETED":
+				return state, true, false
+			case "CANCELED":
+				return state, true, true
+			}
+			return state, false, false
+		},
+	},
+	{
+		start:  "v2_synchronize_db_cloud_provider",
+		status: "v2_get_cloud_provider_synchorinize_job_history",
+		statusArguments: func(arguments, started map[string]interface{}) (map[string]interface{}, bool) {
+			provider, _ := arguments["uuid"].(string)
+			history, ok := started["historyDetailUuid"].(string)
+			return map[string]interface{}{"cloudProviderUuid": provider, "historyDetailUuid": history}, ok && history != "" && provider != ""
+		},
+		state: func(status map[string]interface{}) (string, bool, bool) {
+			detail, _ := status["historyDetail"].(map[string]interface{})
+			state, _ := detail["result"].(string)
+			switch state {
+			case "SUCCESS":
+				return state, true, false
+			case "FAILURE", "BLOCKED":
+				return state, true, true
+			}
+			return state, false, false
+		},
+	},
+}
+
+// jobTools returns a tool for each job whose operations are both served, which starts the job and waits until it is finished.
+func jobTools(tools []operationTool) []operationTool {
+	byOperation := make(map[string]operationTool, len(tools))
+	for _, tool := range tools {
+		byOperation[tool.operation.op.OperationId] = tool
+	}
+
+	var waiting []operationTool
+	for _, spec := range jobSpecs {
+		start, ok := byOperation[spec.start]
+		if !ok {
+			continue
+		}
+		status, ok := byOperation[spec.status]
+		if !ok {
+			continue
+		}
+
+		tool := start
+		tool.Tool.Name = start.Tool.Name + jobToolSuffix
+		tool.Tool.Description = fmt.Sprintf("%s\n\nWaits until the job is finished, reporting progress, and returns its final status from %s.", start.Tool.Description, status.Tool.Name)
+		tool.Handler = newJobHandler(spec, start, status)
+		tool.waits = true
+		waiting = append(waiting, tool)
+	}
+	return waiting
+}
+
+func newJobHandler(spec jobSpec, start, status operationTool) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := start.Handler(ctx, request)
+		if err != nil || result.IsError || dryRunFromContext(ctx) {
+			return result, err
+		}
+
+		var started map[string]interface{}
+		if err := json.Unmarshal([]byte(resultText(result)), &started); err != nil {
+			return nil, fmt.Errorf("malformed response of %s: %w", start.Tool.Name, err)
+		}
+		statusArguments, ok := spec.statusArguments(request.Params.Arguments, started)
+		if !ok {
+			return nil, fmt.Errorf("no job ID in the response of %s", start.Tool.Name)
+		}
+
+		progress := newProgressReporter(ctx, request)
+		progress.report(0, "The job is started")
+
+		var statusRequest mcp.CallToolRequest
+		statusRequest.Params.Name = status.Tool.Name
+		statusRequest.Params.Arguments = statusArguments
+
+		interval := jobPollInitialInterval
+		for polls := 1; ; polls++ {
+			select {
+			case <-ctx.Done():
+				return newStillRunningResult(ctx, status.Tool.Name, statusArguments), nil
+			case <-time.After(interval):
+			}
+
+			result, err := status.Handler(ctx, statusRequest)
+			if err != nil {
+				if ctx.Err() != nil {
+					return newStillRunningResult(ctx, status.Tool.Name, statusArguments), nil
+				}
+				return nil, err
+			}
+			if result.IsError {
+				return result, nil
+			}
+
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(resultText(result)), &body); err != nil {
+				return nil, fmt.Errorf("malformed response of %s: %w", status.Tool.Name, err)
+			}
+			state, finished, failed := spec.state(body)
+			if finished {
+				result.IsError = failed
+				return result, nil
+			}
+
+			progress.report(polls, fmt.Sprintf("The job is %s", state))
+			interval = min(interval*3/2, jobPollMaxInterval)
+		}
+	}
+}
+
+// newStillRunningResult tells the model the job was not waited for until the end, and how to check it.
+func newStillRunningResult(ctx context.Context, statusTool string, statusArguments map[string]interface{}) *mcp.CallToolResult {
+	arguments, _ := json.Marshal(statusArguments)
+	return mcp.NewToolResultError(fmt.Sprintf("Stopped waiting for the job (%s). It may still be running in QueryPie. Check it with %s %s.",
+		cancelReason(context.Cause(ctx)), statusTool, arguments))
+}
+
+func resultText(result *mcp.CallToolResult) string {
+	for _, content := range result.Content {
+		if text, ok := content.(mcp.TextContent); ok {
+			return text.Text
+		}
+	}
+	return ""
+}
+
+// progressReporter sends progress notifications for the progress token of a call, if the client sent one.
+type progressReporter struct {
+	ctx   context.Context
+	srv   *server.MCPServer
+	token mcp.ProgressToken
+}
+
+func newProgressReporter(ctx context.Context, request mcp.CallToolRequest) *progressReporter {
+	r := &progressReporter{ctx: ctx, srv: server.ServerFromContext(ctx)}
+	if request.Params.Meta != nil {
+		r.token = request.Params.Meta.ProgressToken
+	}
+	return r
+}
+
+func (r *progressReporter) report(progress int, message string) {
+	if r.srv == nil || r.token == nil {
+		return
+	}
+	_ = r.srv.SendNotificationToClient(r.ctx, "notifications/progress", map[string]any{
+		"progressToken": r.token,
+		"progress":      progress,
+		"message":       message,
+	})
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+const jwtLeeway = time.Minute
+
+// jwtClaims are the registered claims this server validates, plus the rest as raw values.
+type jwtClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	Scopes    []string
+	Raw       map[string]interface{}
+}
+
+// jwtVerifier verifies signed JWTs with either a shared HMAC secret or the public keys of a JWKS.
+type jwtVerifier struct {
+	secret   []byte
+	keys     func(kid string) []crypto.PublicKey
+	issuer   string // checked if set
+	audience string // required
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+func (v *jwtVerifier) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	if err := v.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := decodeJWTPart(parts[1], &raw); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	claims := parseJWTClaims(raw)
+
+	now := time.Now()
+	if claims.ExpiresAt.IsZero() {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(claims.ExpiresAt.Add(jwtLeeway)) {
+		return nil, errors.New("token is expired")
+	}
+	if !claims.NotBefore.IsZero() && now.Add(jwtLeeway).Before(claims.NotBefore) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if v.issuer != "" && !sameIssuer(claims.Issuer, v.issuer) {
+		return nil, fmt.Errorf("unexpected token issuer: %s", claims.Issuer)
+	}
+	if v.audience == "" || !containsString(claims.Audience, v.audience) {
+		return nil, errors.New("token is not issued for this server")
+	}
+
+	return claims, nil
+}
+
+// sameIssuer compares issuer URLs the way discovery does, ignoring a trailing slash.
+func sameIssuer(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// jwtAlgorithms maps the supported "alg" values to their signing family and hash.
+var jwtAlgorithms = map[string]struct {
+	family string
+	hash   crypto.Hash
+}{
+	"HS256": {"HS", crypto.SHA256},
+	"HS384": {"HS", crypto.SHA384},
+	"HS512": {"HS", crypto.SHA512},
+	"RS256": {"RS", crypto.SHA256},
+	"RS384": {"RS", crypto.SHA384},
+	"RS512": {"RS", crypto.SHA512},
+	"ES256": {"ES", crypto.SHA256},
+	"ES384": {"ES", crypto.SHA384},
+	"ES512": {"ES", crypto.SHA512},
+}
+
+func (v *jwtVerifier) verifySignature(header jwtHeader, signed, signature []byte) error {
+	algorithm, ok := jwtAlgorithms[header.Algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported token algorithm: %q", header.Algorithm)
+	}
+	hash := algorithm.hash
+
+	switch algorithm.family {
+	case "HS":
+		if v.secret == nil {
+			return fmt.Errorf("unsupported token algorithm: %q", header.Algorithm)
+		}
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "RS", "ES":
+		if v.keys == nil {
+			return fmt.Errorf("unsupported token algorithm: %q", header.Algorithm)
+		}
+		h := hash.New()
+		h.Write(signed)
+		digest := h.Sum(nil)
+
+		for _, key := range v.keys(header.KeyID) {
+			switch key := key.(type) {
+			case *rsa.PublicKey:
+				if algorithm.family == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+					return nil
+				}
+			case *ecdsa.PublicKey:
+				size := (key.Curve.Params().BitSize + 7) / 8
+				if algorithm.family == "ES" && len(signature) == 2*size {
+					r := new(big.Int).SetBytes(signature[:size])
+					s := new(big.Int).SetBytes(signature[size:])
+					if ecdsa.Verify(key, digest, r, s) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("invalid token signature")
+	default:
+		return fmt.Errorf("unsupported token algorithm: %q", header.Algorithm)
+	}
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func parseJWTClaims(raw map[string]interface{}) *jwtClaims {
+	claims := &jwtClaims{Raw: raw}
+	claims.Issuer, _ = raw["iss"].(string)
+	claims.Subject, _ = raw["sub"].(string)
+
+	switch aud := raw["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				claims.Audience = append(claims.Audience, s)
+			}
+		}
+	}
+
+	if exp, ok := raw["exp"].(float64); ok {
+		claims.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	if nbf, ok := raw["nbf"].(float64); ok {
+		claims.NotBefore = time.Unix(int64(nbf), 0)
+	}
+
+	// "scope" is a space separated string (RFC 8693), "scp" is a list in some providers
+	if scope, ok := raw["scope"].(string); ok {
+		claims.Scopes = strings.Fields(scope)
+	} else if scp, ok := raw["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				claims.Scopes = append(claims.Scopes, s)
+			}
+		}
+	}
+
+	return claims
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// jwks is a parsed JSON Web Key Set.
+type jwks struct {
+	keys map[string][]crypto.PublicKey // keyed by kid. keys without kid are stored under ""
+}
+
+func (s *jwks) lookup(kid string) []crypto.PublicKey {
+	if kid == "" {
+		var all []crypto.PublicKey
+		for _, keys := range s.keys {
+			all = append(all, keys...)
+		}
+		return all
+	}
+	keys := append([]crypto.PublicKey{}, s.keys[kid]...)
+	return append(keys, s.keys[""]...)
+}
+
+func loadJWKSFile(filename string) (*jwks, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	return parseJWKS(data)
+}
+
+func parseJWKS(data []byte) (*jwks, error) {
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("malformed JWKS: %w", err)
+	}
+
+	result := &jwks{keys: make(map[string][]crypto.PublicKey)}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		var publicKey crypto.PublicKey
+		switch key.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(key.N)
+			e, errE := base64.RawURLEncoding.DecodeString(key.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("malformed RSA key %q in JWKS", key.KeyID)
+			}
+			publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch key.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(key.X)
+			y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("malformed EC key %q in JWKS", key.KeyID)
+			}
+			publicKey = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		default:
+			continue
+		}
+		result.keys[key.KeyID] = append(result.keys[key.KeyID], publicKey)
+	}
+
+	if len(result.keys) == 0 {
+		return nil, errors.New("no usable signing key in JWKS")
+	}
+	return result, nil
+}
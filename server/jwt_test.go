@@ -0,0 +1,351 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com/"
+	testAudience = "https://mcp.example.com"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func encodeJWTPart(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signJWT builds a token whose signature is made by sign over "<header>.<claims>".
+func signJWT(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	signed := encodeJWTPart(t, header) + "." + encodeJWTPart(t, claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hmacSigner(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func rsaSigner(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+func ecdsaSigner(t *testing.T, key *ecdsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+}
+
+func testJWKS(t *testing.T, rsaKey *rsa.PublicKey, ecKey *ecdsa.PublicKey) *jwks {
+	t.Helper()
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+		},
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestJWTVerifierVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testJWKS(t, &rsaKey.PublicKey, &ecKey.PublicKey)
+
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": testIssuer,
+			"sub": "alice",
+			"aud": testAudience,
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+
+	hmacVerifier := &jwtVerifier{secret: testSecret, issuer: testIssuer, audience: testAudience}
+	jwksVerifier := &jwtVerifier{keys: keys.lookup, issuer: testIssuer, audience: testAudience}
+	bothVerifier := &jwtVerifier{secret: testSecret, keys: keys.lookup, issuer: testIssuer, audience: testAudience}
+
+	tests := []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		wantErr  string
+	}{
+		{
+			name:     "HS256",
+			verifier: hmacVerifier,
+			token:    signJWT(t, hs256, claims(nil), hmacSigner(testSecret)),
+		},
+		{
+			name:     "RS256",
+			verifier: jwksVerifier,
+			token:    signJWT(t, rs256, claims(nil), rsaSigner(t, rsaKey)),
+		},
+		{
+			name:     "ES256",
+			verifier: jwksVerifier,
+			token:    signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "ec"}, claims(nil), ecdsaSigner(t, ecKey)),
+		},
+		{
+			name:     "issuer without trailing slash",
+			verifier: jwksVerifier,
+			token:    signJWT(t, rs256, claims(map[string]interface{}{"iss": strings.TrimSuffix(testIssuer, "/")}), rsaSigner(t, rsaKey)),
+		},
+		{
+			name:     "audience list",
+			verifier: jwksVerifier,
+			token:    signJWT(t, rs256, claims(map[string]interface{}{"aud": []string{"other", testAudience}}), rsaSigner(t, rsaKey)),
+		},
+		{
+			name:     "alg none",
+			verifier: bothVerifier,
+			token:    signJWT(t, map[string]interface{}{"alg": "none"}, claims(nil), func([]byte) []byte { return nil }),
+			wantErr:  "unsupported token algorithm",
+		},
+		{
+			name:     "alg none in upper case",
+			verifier: bothVerifier,
+			token:    signJWT(t, map[string]interface{}{"alg": "NONE"}, claims(nil), func([]byte) []byte { return nil }),
+			wantErr:  "unsupported token algorithm",
+		},
+		{
+			name:     "HS256 signed with the RSA public key",
+			verifier: jwksVerifier,
+			token:    signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims(nil), hmacSigner(publicPEM)),
+			wantErr:  "unsupported token algorithm",
+		},
+		{
+			name:     "HS256 signed with the RSA public key, with an HMAC secret",
+			verifier: bothVerifier,
+			token:    signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims(nil), hmacSigner(publicPEM)),
+			wantErr:  "invalid token signature",
+		},
+		{
+			name:     "HS256 signed with the RSA modulus",
+			verifier: bothVerifier,
+			token:    signJWT(t, hs256, claims(nil), hmacSigner(rsaKey.N.Bytes())),
+			wantErr:  "invalid token signature",
+		},
+		{
+			name:     "RS256 without JWKS",
+			verifier: hmacVerifier,
+			token:    signJWT(t, rs256, claims(nil), rsaSigner(t, rsaKey)),
+			wantErr:  "unsupported token algorithm",
+		},
+		{
+			name:     "ES256 header with the RSA key",
+			verifier: jwksVerifier,
+			token:    signJWT(t, map[string]interface{}{"alg": "ES256", "kid": "rsa"}, claims(nil), rsaSigner(t, rsaKey)),
+			wantErr:  "invalid token signature",
+		},
+		{
+			name:     "wrong secret",
+			verifier: hmacVerifier,
+			token:    signJWT(t, hs256, claims(nil), hmacSigner([]byte("fedcba9876543210fedcba9876543210"))),
+			wantErr:  "invalid token signature",
+		},
+		{
+			name:     "tampered claims",
+			verifier: hmacVerifier,
+			token: func() string {
+				parts := strings.Split(signJWT(t, hs256, claims(nil), hmacSigner(testSecret)), ".")
+				parts[1] = encodeJWTPart(t, claims(map[string]interface{}{"sub": "mallory"}))
+				return strings.Join(parts, ".")
+			}(),
+			wantErr: "invalid token signature",
+		},
+		{
+			name:     "unknown kid",
+			verifier: jwksVerifier,
+			token:    signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "unknown"}, claims(nil), rsaSigner(t, rsaKey)),
+			wantErr:  "invalid token signature",
+		},
+		{
+			name:     "expired",
+			verifier: hmacVerifier,
+			token:    signJWT(t, hs256, claims(map[string]interface{}{"exp": now.Add(-2 * jwtLeeway).Unix()}), hmacSigner(testSecret)),
+			wantErr:  "token is expired",
+		},
+		{
+			name:     "expired within leeway",
+			verifier: hmacVerifier,
+			token:    signJWT(t, hs256, claims(map[string]interface{}{"exp": now.Add(-jwtLeeway / 2).Unix()}), hmacSigner(testSecret)),
+		},
+		{
+			name:     "no expiry",
+			verifier: hmacVerifier,
+			token:    signJWT(t, hs256, claims(map[string]interface{}{"exp": nil}), hmacSigner(testSecret)),
+			wantErr:  "token has no expiry",
+		},
+		{
+			name:     "not valid yet",
+			verifier: hmacVerifier,
+			token:    signJWT(t, hs256, claims(map[string]interface{}{"nbf": now.Add(2 * jwtLeeway).Unix()}), hmacSigner(testSecret)),
+			wantErr:  "token is not valid yet",
+		},
+		{
+			name:     "wrong audience",
+			verifier: jwksVerifier,
+			token:    signJWT(t, rs256, claims(map[string]interface{}{"aud": "https://other.example.com"}), rsaSigner(t, rsaKey)),
+			wantErr:  "token is not issued for this server",
+		},
+		{
+			name:     "no audience",
+			verifier: jwksVerifier,
+			token:    signJWT(t, rs256, claims(map[string]interface{}{"aud": nil}), rsaSigner(t, rsaKey)),
+			wantErr:  "token is not issued for this server",
+		},
+		{
+			name:     "empty audience of a verifier without one",
+			verifier: &jwtVerifier{secret: testSecret},
+			token:    signJWT(t, hs256, claims(map[string]interface{}{"aud": ""}), hmacSigner(testSecret)),
+			wantErr:  "token is not issued for this server",
+		},
+		{
+			name:     "wrong issuer",
+			verifier: jwksVerifier,
+			token:    signJWT(t, rs256, claims(map[string]interface{}{"iss": "https://evil.example.com/"}), rsaSigner(t, rsaKey)),
+			wantErr:  "unexpected token issuer",
+		},
+		{
+			name:     "malformed",
+			verifier: hmacVerifier,
+			token:    "not.a.token",
+			wantErr:  "malformed token",
+		},
+		{
+			name:     "two parts",
+			verifier: hmacVerifier,
+			token:    "header.claims",
+			wantErr:  "malformed token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.verifier.verify(tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify() error = %v", err)
+				}
+				if got.Subject != "alice" {
+					t.Errorf("verify() subject = %q, want alice", got.Subject)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("verify() accepted the token, want error %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewInboundAuthenticatorRequiresJWTClaims(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeTestFile(t, secretFile, string(testSecret))
+	writeTestFile(t, jwksFile, `{"keys":[{"kty":"EC","kid":"ec","crv":"P-256","x":"f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU","y":"x_FEzRu9m36HLN_tue659LNpXW6pCyStikYjKIWI5a0"}]}`)
+
+	tests := []struct {
+		name    string
+		config  InboundAuthConfig
+		wantErr bool
+	}{
+		{"HMAC without audience", InboundAuthConfig{HMACSecretFile: secretFile}, true},
+		{"HMAC with audience", InboundAuthConfig{HMACSecretFile: secretFile, Audience: testAudience}, false},
+		{"JWKS without audience", InboundAuthConfig{JWKSFile: jwksFile, Issuer: testIssuer}, true},
+		{"JWKS without issuer", InboundAuthConfig{JWKSFile: jwksFile, Audience: testAudience}, true},
+		{"JWKS with issuer and audience", InboundAuthConfig{JWKSFile: jwksFile, Issuer: testIssuer, Audience: testAudience}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newInboundAuthenticator(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newInboundAuthenticator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	unixSocketPrefix      = "unix://"
+	DefaultUnixSocketMode = os.FileMode(0o660)
+
+	listenFDsStart = 3 // the first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+)
+
+// listen opens the listener of the network transports: a socket inherited from the service manager,
+// a unix socket, or a TCP address. It also returns the address for logging.
+func (s *Server) listen() (net.Listener, string, error) {
+	listener, err := inheritedListener()
+	if err != nil {
+		return nil, "", err
+	}
+	if listener != nil {
+		if s.listenAddress != "" {
+			slog.Warn("   • --listen is ignored. The socket passed by the service manager is used", "listen", s.listenAddress)
+		}
+		return listener, "inherited socket " + listener.Addr().String(), nil
+	}
+
+	address := s.listenAddress
+	if address == "" {
+		address = fmt.Sprintf(":%d", s.port)
+	}
+	listener, err = listenOn(address, s.socketMode)
+	return listener, address, err
+}
+
+// listenOn listens on a TCP address, or on a unix socket if the address starts with unix://.
+func listenOn(address string, socketMode os.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, unixSocketPrefix); ok {
+		return listenUnix(path, socketMode)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	return listener, nil
+}
+
+// listenUnix listens on a unix socket, replacing the socket left by a previous run.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	if mode == 0 {
+		mode = DefaultUnixSocketMode
+	}
+	listener, err := listenUnixSocket(path, mode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	// the umask may only remove permissions, so the mode is still set as given
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set the permissions of %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// inheritedListener returns the socket passed by systemd socket activation (LISTEN_FDS), or nil if there is none.
+func inheritedListener() (net.Listener, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	// the variables are meant for this process only, not for commands it runs
+	pid := os.Getenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", fds)
+	}
+	if n > 1 {
+		slog.Warn("   • Several sockets are passed by the service manager. Only the first one is used", "count", n)
+	}
+
+	file := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_3")
+	if file == nil {
+		return nil, errors.New("the socket passed by the service manager is not open")
+	}
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("the file passed by the service manager is not a listening socket: %w", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package server
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnixSocket creates the socket with the umask set so that it has no more than the given permissions,
+// as it would otherwise be reachable with the default ones until it is chmod-ed.
+// The umask is process-wide, but nothing else creates files while the server starts listening.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	umask := syscall.Umask(int(^mode & os.ModePerm))
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package server
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnixSocket creates the socket. Windows has no umask, and ignores the permissions of unix sockets.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// operationTool is a tool that calls a single QueryPie API operation.
+type operationTool struct {
+	server.ServerTool
+	operation *operation
+	client    *querypieClient
+	waits     bool // waits for the QueryPie job the operation starts to finish
+}
+
+// mutating reports whether the tool changes state in QueryPie.
+func (t operationTool) mutating() bool {
+	return t.operation.mutating()
+}
+
+// toolMiddleware wraps a tool handler to run logic before or after the upstream call.
+type toolMiddleware func(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc
+
+// applyMiddlewares wraps every tool handler with the given middlewares.
+// The first middleware is the outermost one.
+func applyMiddlewares(tools []operationTool, middlewares ...toolMiddleware) []operationTool {
+	wrapped := make([]operationTool, len(tools))
+	for i, tool := range tools {
+		handler := tool.Handler
+		for j := len(middlewares) - 1; j >= 0; j-- {
+			if middlewares[j] == nil {
+				continue
+			}
+			handler = middlewares[j](tool, handler)
+		}
+		wrapped[i] = tool
+		wrapped[i].Handler = handler
+	}
+	return wrapped
+}
+
+func serverTools(tools []operationTool) []server.ServerTool {
+	serverTools := make([]server.ServerTool, len(tools))
+	for i, tool := range tools {
+		serverTools[i] = tool.ServerTool
+	}
+	return serverTools
+}
+
+// readTools returns the tools that do not change state in QueryPie.
+func readTools(tools []operationTool) []operationTool {
+	var reads []operationTool
+	for _, tool := range tools {
+		if !tool.mutating() {
+			reads = append(reads, tool)
+		}
+	}
+	return reads
+}
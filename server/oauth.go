@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	protectedResourcePath = "/.well-known/oauth-protected-resource"
+	oauthRequestTimeout   = 10 * time.Second
+
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute // how often a refresh may be attempted, such as for an unknown kid
+)
+
+// protectedResource describes this server to OAuth clients (RFC 9728), so they can find where to get a token.
+type protectedResource struct {
+	Resource               string   `json:"resource"`
+	AuthorizationServers   []string `json:"authorization_servers"`
+	ScopesSupported        []string `json:"scopes_supported"`
+	BearerMethodsSupported []string `json:"bearer_methods_supported"`
+	ResourceName           string   `json:"resource_name"`
+}
+
+// oauthResource validates the access tokens an OAuth authorization server issues for this server.
+type oauthResource struct {
+	resource            *url.URL
+	authorizationServer string
+	verifier            *jwtVerifier
+}
+
+func newOAuthResource(config InboundAuthConfig) (*oauthResource, error) {
+	if config.Resource == "" {
+		return nil, errors.New("the resource URL of this server is required with an OAuth authorization server")
+	}
+	resource, err := url.Parse(config.Resource)
+	if err != nil || (resource.Scheme != "http" && resource.Scheme != "https") || resource.Host == "" {
+		return nil, fmt.Errorf("invalid resource URL: %s", config.Resource)
+	}
+
+	client := &http.Client{Timeout: oauthRequestTimeout}
+	jwksURL := config.JWKSURL
+	issuer := config.AuthorizationServer
+	if jwksURL == "" {
+		jwksURL, issuer, err = discoverJWKSURL(client, config.AuthorizationServer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keys := &remoteJWKS{url: jwksURL, client: client}
+	if err := keys.refresh(); err != nil {
+		return nil, err
+	}
+
+	// tokens must be issued for this server (RFC 8707), unless another audience is configured
+	audience := config.Audience
+	if audience == "" {
+		audience = config.Resource
+	}
+
+	return &oauthResource{
+		resource:            resource,
+		authorizationServer: config.AuthorizationServer,
+		verifier: &jwtVerifier{
+			keys:     keys.lookup,
+			issuer:   issuer,
+			audience: audience,
+		},
+	}, nil
+}
+
+// metadataPath is where the protected resource metadata is served, suffixed with the path of the resource.
+func (o *oauthResource) metadataPath() string {
+	return protectedResourcePath + strings.TrimSuffix(o.resource.Path, "/")
+}
+
+func (o *oauthResource) metadataURL() string {
+	u := *o.resource
+	u.Path = o.metadataPath()
+	u.RawQuery = ""
+	return u.String()
+}
+
+func (o *oauthResource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(protectedResource{
+		Resource:               o.resource.String(),
+		AuthorizationServers:   []string{o.authorizationServer},
+		ScopesSupported:        []string{scopeRead, scopeWrite},
+		BearerMethodsSupported: []string{"header"},
+		ResourceName:           "mcp-querypie",
+	})
+}
+
+// discoverJWKSURL reads the authorization server metadata (RFC 8414), or the OpenID configuration, of the issuer.
+// It also returns the issuer as the metadata spells it, which is the one of the tokens.
+func discoverJWKSURL(client *http.Client, issuer string) (string, string, error) {
+	u, err := url.Parse(issuer)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("invalid authorization server: %s", issuer)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	candidates := []string{
+		fmt.Sprintf("%s://%s/.well-known/oauth-authorization-server%s", u.Scheme, u.Host, path),
+		fmt.Sprintf("%s://%s%s/.well-known/openid-configuration", u.Scheme, u.Host, path),
+	}
+
+	for _, candidate := range candidates {
+		var metadata struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(client, candidate, &metadata); err != nil {
+			slog.Debug("failed to read authorization server metadata", "url", candidate, "error", err)
+			continue
+		}
+		if metadata.Issuer != "" && !sameIssuer(metadata.Issuer, issuer) {
+			return "", "", fmt.Errorf("authorization server metadata at %s is for another issuer: %s", candidate, metadata.Issuer)
+		}
+		if metadata.JWKSURI != "" {
+			if metadata.Issuer != "" {
+				issuer = metadata.Issuer
+			}
+			return metadata.JWKSURI, issuer, nil
+		}
+	}
+	return "", "", fmt.Errorf("no authorization server metadata with jwks_uri found for %s", issuer)
+}
+
+// remoteJWKS is the JWKS of an authorization server. It is refreshed periodically,
+// and when a token is signed with a key it does not know yet.
+type remoteJWKS struct {
+	url    string
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        *jwks
+	fetchedAt   time.Time
+	attemptedAt time.Time     // of the last refresh, even if it failed
+	refreshing  chan struct{} // closed when the running refresh is done, nil if none runs
+}
+
+func (r *remoteJWKS) lookup(kid string) []crypto.PublicKey {
+	r.mu.Lock()
+	now := time.Now()
+	unknown := kid != "" && len(r.keys.keys[kid]) == 0
+	// whatever asks for it, the authorization server is not asked more than once per jwksMinRefreshInterval
+	due := (now.Sub(r.fetchedAt) > jwksRefreshInterval || unknown) && now.Sub(r.attemptedAt) > jwksMinRefreshInterval
+	done := r.refreshing
+	start := due && done == nil
+	if start {
+		done = make(chan struct{})
+		r.refreshing = done
+		r.attemptedAt = now
+	}
+	r.mu.Unlock()
+
+	switch {
+	case start:
+		if err := r.refreshShared(done); err != nil {
+			// keep the current keys, the authorization server may be briefly unavailable
+			slog.Warn("• Failed to refresh the JWKS of the authorization server", "url", r.url, "error", err)
+		}
+	case unknown && done != nil:
+		// the key may be in the refresh running now
+		<-done
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys.lookup(kid)
+}
+
+func (r *remoteJWKS) refresh() error {
+	r.mu.Lock()
+	r.attemptedAt = time.Now()
+	r.mu.Unlock()
+	return r.refreshShared(nil)
+}
+
+// refreshShared gets the keys without holding the lock, and closes done once they are stored.
+func (r *remoteJWKS) refreshShared(done chan struct{}) error {
+	var raw json.RawMessage
+	err := getJSON(r.client, r.url, &raw)
+	var keys *jwks
+	if err == nil {
+		keys, err = parseJWKS(raw)
+	} else {
+		err = fmt.Errorf("failed to get JWKS: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if done != nil {
+		defer close(done)
+		r.refreshing = nil
+	}
+	if err != nil {
+		return err
+	}
+	r.keys = keys
+	r.fetchedAt = time.Now()
+	return nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -4,12 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
-	"path"
 	"strings"
 
 	"github.com/mark3labs/mcp-go/mcp"
@@ -28,13 +28,8 @@ const (
 	SchemaTypeObject  SchemaType = "object"
 )
 
-func parseToolsFromOpenAPI(ctx context.Context, querypieAPIKey, querypieURL string, model v3.Document) ([]server.ServerTool, error) {
-	tools := []server.ServerTool{}
-
-	serverURL, err := url.Parse(querypieURL)
-	if err != nil {
-		return nil, fmt.Errorf("malformed querypie URL: %w", err)
-	}
+func parseToolsFromOpenAPI(ctx context.Context, client *querypieClient, model v3.Document) ([]operationTool, error) {
+	tools := []operationTool{}
 
 	for pair := model.Paths.PathItems.First(); pair != nil; pair = pair.Next() {
 		pathKey := pair.Key()
@@ -83,159 +78,228 @@ func parseToolsFromOpenAPI(ctx context.Context, querypieAPIKey, querypieURL stri
 			}
 
 			// Add request body if present
-			if op.op.RequestBody != nil && op.op.RequestBody.Content != nil {
-				if mediaType, ok := op.op.RequestBody.Content.Get("application/json"); ok && mediaType != nil {
-					if mediaType.Schema != nil && mediaType.Schema.Schema() != nil {
-						schema := mediaType.Schema.Schema()
-
-						// flattening the schema
-						if schema.Properties != nil {
-							for propPair := schema.Properties.First(); propPair != nil; propPair = propPair.Next() {
-								schemaType, promptOpts := convertSchemaToToolOption(propPair.Value().Schema())
-								switch schemaType {
-								case SchemaTypeString:
-									toolOpts = append(toolOpts, mcp.WithString(propPair.Key(), promptOpts...))
-								case SchemaTypeInteger:
-									toolOpts = append(toolOpts, mcp.WithNumber(propPair.Key(), promptOpts...))
-								case SchemaTypeBoolean:
-									toolOpts = append(toolOpts, mcp.WithBoolean(propPair.Key(), promptOpts...))
-								case SchemaTypeArray:
-									toolOpts = append(toolOpts, mcp.WithArray(propPair.Key(), promptOpts...))
-								case SchemaTypeObject:
-									toolOpts = append(toolOpts, mcp.WithObject(propPair.Key(), promptOpts...))
-								}
-							}
+			if schema := requestBodySchema(op.op); schema != nil {
+				// flattening the schema
+				if schema.Properties != nil {
+					for propPair := schema.Properties.First(); propPair != nil; propPair = propPair.Next() {
+						schemaType, promptOpts := convertSchemaToToolOption(propPair.Value().Schema())
+						switch schemaType {
+						case SchemaTypeString:
+							toolOpts = append(toolOpts, mcp.WithString(propPair.Key(), promptOpts...))
+						case SchemaTypeInteger:
+							toolOpts = append(toolOpts, mcp.WithNumber(propPair.Key(), promptOpts...))
+						case SchemaTypeBoolean:
+							toolOpts = append(toolOpts, mcp.WithBoolean(propPair.Key(), promptOpts...))
+						case SchemaTypeArray:
+							toolOpts = append(toolOpts, mcp.WithArray(propPair.Key(), promptOpts...))
+						case SchemaTypeObject:
+							toolOpts = append(toolOpts, mcp.WithObject(propPair.Key(), promptOpts...))
 						}
-
 					}
 				}
 			}
 
-			tools = append(tools, server.ServerTool{
-				Tool: mcp.NewTool(operationID, toolOpts...),
-				Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-					u := *serverURL
-					u.Path = path.Join(u.Path, pathKey)
+			if hasCatchAll(pathKey) {
+				toolOpts = append(toolOpts, mcp.WithString(catchAllArgument,
+					mcp.Description(fmt.Sprintf("Remaining path after %s/, which may contain multiple segments separated by '/'", strings.TrimSuffix(pathKey, "/**"))),
+					mcp.Required(),
+				))
+			}
 
-					headers := make(http.Header)
+			toolOpts = append(toolOpts, mcp.WithBoolean(dryRunArgument, mcp.Description(dryRunDescription)))
 
-					// Handle path params
-					for _, param := range pathItem.Parameters {
-						if param == nil {
-							continue
-						}
+			operation := &operation{
+				method:   op.method,
+				pathKey:  pathKey,
+				pathItem: pathItem,
+				op:       op.op,
+			}
 
-						if value, ok := request.Params.Arguments[param.Name]; ok {
-							switch param.In {
-							case "path":
-								u.Path = strings.ReplaceAll(u.Path, fmt.Sprintf("{%s}", param.Name), url.PathEscape(fmt.Sprint(value)))
-							case "query":
-								switch v := value.(type) {
-								case []interface{}:
-									values := make([]string, len(v))
-									for i, item := range v {
-										values[i] = fmt.Sprint(item)
-									}
-									u.Query().Add(param.Name, strings.Join(values, ","))
-								default:
-									u.Query().Add(param.Name, fmt.Sprint(value))
-								}
-							case "header":
-								headers.Add(param.Name, fmt.Sprint(value))
-							}
-						}
-					}
+			tools = append(tools, operationTool{
+				ServerTool: server.ServerTool{
+					Tool:    mcp.NewTool(operationID, toolOpts...),
+					Handler: client.newToolHandler(operation),
+				},
+				operation: operation,
+				client:    client,
+			})
+		}
+	}
 
-					// Handle operation params
-					for _, param := range op.op.Parameters {
-						if param == nil {
-							continue
-						}
+	return tools, nil
+}
 
-						if value, ok := request.Params.Arguments[param.Name]; ok {
-							switch param.In {
-							case "path":
-								u.Path = strings.ReplaceAll(u.Path, fmt.Sprintf("{%s}", param.Name), url.PathEscape(fmt.Sprint(value)))
-							case "query":
-								u.Query().Add(param.Name, fmt.Sprint(value))
-							case "header":
-								headers.Add(param.Name, fmt.Sprint(value))
-							}
-						}
-					}
+// operation is a single OpenAPI operation exposed as a tool.
+type operation struct {
+	method   string
+	pathKey  string
+	pathItem *v3.PathItem
+	op       *v3.Operation
+}
 
-					// Handle request body
-					body := make(map[string]interface{})
-					if op.op.RequestBody != nil && op.op.RequestBody.Content != nil {
-						if mediaType, ok := op.op.RequestBody.Content.Get("application/json"); ok && mediaType != nil {
-							if mediaType.Schema != nil && mediaType.Schema.Schema() != nil {
-								schema := mediaType.Schema.Schema()
-								if schema.Properties != nil {
-									for pair := schema.Properties.First(); pair != nil; pair = pair.Next() {
-										if value, ok := request.Params.Arguments[pair.Key()]; ok {
-											body[pair.Key()] = value
-										}
-									}
-								}
-							}
-						}
-					}
+// mutating reports whether the operation changes state in QueryPie.
+func (o *operation) mutating() bool {
+	return o.method != http.MethodGet
+}
 
-					var reqBody io.Reader
-					if len(body) > 0 {
-						jsonBody, err := json.Marshal(body)
-						if err != nil {
-							return nil, fmt.Errorf("failed to marshal request body: %w", err)
-						}
-						reqBody = bytes.NewReader(jsonBody)
-					}
+// parameters returns the path item's parameters followed by the operation's own.
+func (o *operation) parameters() []*v3.Parameter {
+	params := make([]*v3.Parameter, 0, len(o.pathItem.Parameters)+len(o.op.Parameters))
+	params = append(params, o.pathItem.Parameters...)
+	params = append(params, o.op.Parameters...)
+	return params
+}
 
-					req, err := http.NewRequest(op.method, u.String(), reqBody)
-					if err != nil {
-						return nil, fmt.Errorf("failed to create request: %w", err)
-					}
+// buildRequest converts the tool arguments into an HTTP request to QueryPie.
+// The returned request carries no credentials yet.
+func (o *operation) buildRequest(ctx context.Context, baseURL *url.URL, arguments map[string]interface{}) (*http.Request, []byte, error) {
+	u := *baseURL
+
+	headers := make(http.Header)
+	query := u.Query()
+	pathValues := make(map[string]string)
 
-					req.Header = headers.Clone()
-					req.Header.Set("Content-Type", "application/json")
-					req.Header.Set("Authorization", "Bearer "+querypieAPIKey)
+	for _, param := range o.parameters() {
+		if param == nil {
+			continue
+		}
 
-					resp, err := http.DefaultClient.Do(req)
-					if err != nil {
-						return nil, fmt.Errorf("failed to send request: %w", err)
+		if value, ok := arguments[param.Name]; ok {
+			switch param.In {
+			case "path":
+				pathValues[param.Name] = fmt.Sprint(value)
+			case "query":
+				switch v := value.(type) {
+				case []interface{}:
+					values := make([]string, len(v))
+					for i, item := range v {
+						values[i] = fmt.Sprint(item)
 					}
+					query.Add(param.Name, strings.Join(values, ","))
+				default:
+					query.Add(param.Name, fmt.Sprint(value))
+				}
+			case "header":
+				headers.Add(param.Name, fmt.Sprint(value))
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
 
-					defer resp.Body.Close()
+	var catchAll string
+	if hasCatchAll(o.pathKey) {
+		if value, ok := arguments[catchAllArgument]; ok {
+			catchAll = fmt.Sprint(value)
+		}
+	}
+	escapedPath, err := resolvePath(baseURL.EscapedPath(), o.pathKey, pathValues, catchAll)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Path, err = url.PathUnescape(escapedPath); err != nil {
+		return nil, nil, fmt.Errorf("malformed request path: %w", err)
+	}
+	u.RawPath = escapedPath
+
+	// Handle request body
+	body := make(map[string]interface{})
+	if schema := requestBodySchema(o.op); schema != nil && schema.Properties != nil {
+		for pair := schema.Properties.First(); pair != nil; pair = pair.Next() {
+			if value, ok := arguments[pair.Key()]; ok {
+				body[pair.Key()] = value
+			}
+		}
+	}
 
-					bodyBytes, err := io.ReadAll(resp.Body)
-					if err != nil {
-						return nil, fmt.Errorf("failed to read response body: %w", err)
-					}
+	var jsonBody []byte
+	var reqBody io.Reader
+	if len(body) > 0 {
+		jsonBody, err = json.Marshal(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reqBody = bytes.NewReader(jsonBody)
+	}
 
-					var result *mcp.CallToolResult
-					if resp.StatusCode >= 400 {
-						result = &mcp.CallToolResult{
-							Result: mcp.Result{},
-							Content: []mcp.Content{
-								mcp.NewTextContent(string(bodyBytes)),
-							},
-							IsError: true,
-						}
-					} else {
-						result = &mcp.CallToolResult{
-							Result: mcp.Result{},
-							Content: []mcp.Content{
-								mcp.NewTextContent(string(bodyBytes)),
-							},
-							IsError: false,
-						}
-					}
-					return result, nil
+	req, err := http.NewRequestWithContext(ctx, o.method, u.String(), reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header = headers
+	req.Header.Set("Content-Type", "application/json")
+	return req, jsonBody, nil
+}
+
+func (c *querypieClient) newToolHandler(o *operation) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		req, body, err := o.buildRequest(ctx, c.baseURL, request.Params.Arguments)
+		var argErr *argumentError
+		if errors.As(err, &argErr) {
+			return mcp.NewToolResultError(argErr.Error()), nil
+		} else if err != nil {
+			return nil, err
+		}
+		apiKey, err := c.apiKeyFor(ctx, o.mutating())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get QueryPie API key: %w", err)
+		}
+		if apiKey == "" {
+			return mcp.NewToolResultError("No QueryPie API key. Send your QueryPie API token in the X-QueryPie-API-Key (or Authorization) header of the MCP connection."), nil
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		if user := actingUserFromContext(ctx); user != nil {
+			req.Header.Set(user.header, user.value)
+		}
+
+		if dryRunFromContext(ctx) {
+			return newDryRunResult(req, body)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+
+		defer resp.Body.Close()
+
+		bodyBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+
+		var result *mcp.CallToolResult
+		if resp.StatusCode >= 400 {
+			result = &mcp.CallToolResult{
+				Result: mcp.Result{},
+				Content: []mcp.Content{
+					mcp.NewTextContent(string(bodyBytes)),
 				},
-			})
+				IsError: true,
+			}
+		} else {
+			result = &mcp.CallToolResult{
+				Result: mcp.Result{},
+				Content: []mcp.Content{
+					mcp.NewTextContent(string(bodyBytes)),
+				},
+				IsError: false,
+			}
 		}
+		return result, nil
 	}
+}
 
-	return tools, nil
+// requestBodySchema returns the JSON request body schema of the operation, if any.
+func requestBodySchema(op *v3.Operation) *base.Schema {
+	if op.RequestBody == nil || op.RequestBody.Content == nil {
+		return nil
+	}
+	mediaType, ok := op.RequestBody.Content.Get("application/json")
+	if !ok || mediaType == nil || mediaType.Schema == nil {
+		return nil
+	}
+	return mediaType.Schema.Schema()
 }
 
 func convertParamToToolOption(param *v3.Parameter) mcp.ToolOption {
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Option configures the Server.
+type Option func(*Server)
+
+// WithServerOptions passes options through to the underlying MCP server.
+func WithServerOptions(opts ...server.ServerOption) Option {
+	return func(s *Server) {
+		s.opts = append(s.opts, opts...)
+	}
+}
+
+// WithRateLimits limits how fast and how many tool calls are sent to QueryPie.
+func WithRateLimits(config RateLimitConfig) Option {
+	return func(s *Server) {
+		s.rateLimits = config
+	}
+}
+
+// WithDryRun renders every request instead of sending it to QueryPie.
+func WithDryRun(dryRun bool) Option {
+	return func(s *Server) {
+		s.dryRun = dryRun
+	}
+}
+
+// WithApproval asks an external hook for a verdict before each mutating tool call.
+func WithApproval(config ApprovalConfig) Option {
+	return func(s *Server) {
+		s.approval = config
+	}
+}
+
+// WithWriteWindow starts the server read-only and enables mutating tools only for a limited time.
+func WithWriteWindow(config WriteWindowConfig) Option {
+	return func(s *Server) {
+		s.writeWindow = config
+	}
+}
+
+// WithInboundAuth requires MCP clients of the network transports to authenticate.
+func WithInboundAuth(config InboundAuthConfig) Option {
+	return func(s *Server) {
+		s.inboundAuth = config
+	}
+}
+
+// WithAPIKeyFile reads the QueryPie API key from a file, and reloads it when the file changes.
+func WithAPIKeyFile(filename string) Option {
+	return func(s *Server) {
+		s.apiKeyFile = filename
+	}
+}
+
+// WithAPIKeyCommand reads the QueryPie API key from the output of a command, cached for ttl.
+func WithAPIKeyCommand(command string, ttl time.Duration) Option {
+	return func(s *Server) {
+		s.apiKeyCommand = command
+		s.apiKeyCommandTTL = ttl
+	}
+}
+
+// WithSkipProbe skips verifying the QueryPie API key and detecting the API areas it can use at startup.
+func WithSkipProbe(skip bool) Option {
+	return func(s *Server) {
+		s.skipProbe = skip
+	}
+}
+
+// WithWriteAPIKey sends mutating tool calls with a separate key, or a key read from a file.
+// Without either, mutating tools are disabled and only the server's own key is used for reading.
+func WithWriteAPIKey(key string, filename string) Option {
+	return func(s *Server) {
+		s.separateWriteKey = true
+		s.writeAPIKey = key
+		s.writeAPIKeyFile = filename
+	}
+}
+
+// WithInstances serves several QueryPie deployments instead of the one given to NewServer.
+// The tools of each instance are prefixed with its name.
+func WithInstances(instances []InstanceConfig) Option {
+	return func(s *Server) {
+		s.instances = instances
+	}
+}
+
+// WithIdentityHeader sends the user of each tool call to QueryPie in the header, such as X-Forwarded-User.
+func WithIdentityHeader(header string) Option {
+	return func(s *Server) {
+		s.identityHeader = header
+	}
+}
+
+// WithTLS serves the network transports over TLS, and requires client certificates if a client CA is set.
+func WithTLS(config TLSConfig) Option {
+	return func(s *Server) {
+		s.tls = config
+	}
+}
+
+// WithListen listens on a TCP address such as 127.0.0.1:8000, or on a unix socket such as unix:///run/querypie-mcp.sock
+// created with the given permissions, instead of all interfaces on the port.
+func WithListen(address string, socketMode os.FileMode) Option {
+	return func(s *Server) {
+		s.listenAddress = address
+		s.socketMode = socketMode
+	}
+}
+
+// WithDrainTimeout sets how long running tool calls may take to finish when the server is stopped.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.drainTimeout = timeout
+	}
+}
+
+// WithHealth serves the health and tool listing endpoints with the network transports.
+func WithHealth(config HealthConfig) Option {
+	return func(s *Server) {
+		s.health = config
+	}
+}
+
+// WithPublicAddress serves the MCP endpoints under a path prefix, and advertises the message endpoint of SSE
+// with the URL clients reach the server at through a reverse proxy. publicURL may be nil.
+func WithPublicAddress(basePath string, publicURL *url.URL) Option {
+	return func(s *Server) {
+		s.basePath = strings.TrimSuffix(basePath, "/")
+		s.publicURL = publicURL
+	}
+}
+
+// WithAllowedOrigins allows browser pages of these origins, such as https://app.example.com, to call the
+// Streamable HTTP endpoint besides localhost and the public URL.
+func WithAllowedOrigins(origins []string) Option {
+	return func(s *Server) {
+		s.allowedOrigins = origins
+	}
+}
+
+// WithToolTimeouts limits how long the request of each tool to QueryPie may take.
+func WithToolTimeouts(timeouts ToolTimeouts) Option {
+	return func(s *Server) {
+		s.toolTimeouts = timeouts
+	}
+}
+
+// WithSpecDownload downloads the OpenAPI specification of QueryPie versions not bundled in the binary
+// from the latest GitHub release, and caches it.
+func WithSpecDownload(enabled bool) Option {
+	return func(s *Server) {
+		s.downloadSpec = enabled
+	}
+}
+
+// WithOpenAPI loads the OpenAPI specification from a file path, a file:// URL or an https:// URL,
+// instead of the one of the QueryPie version. Instances of the config file may set their own.
+func WithOpenAPI(source string) Option {
+	return func(s *Server) {
+		s.openapi = source
+	}
+}
+
+// WithCacheDir caches downloaded specifications in dir instead of the user cache directory.
+func WithCacheDir(dir string) Option {
+	return func(s *Server) {
+		if dir != "" {
+			s.cacheDir = dir
+		}
+	}
+}
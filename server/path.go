@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// catchAllArgument is the tool argument that fills a trailing "**" segment of a path.
+const catchAllArgument = "wildcardPath"
+
+var pathPlaceholderRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// argumentError is a problem with the arguments the model passed, reported back as a tool error.
+type argumentError struct {
+	message string
+}
+
+func (e *argumentError) Error() string {
+	return e.message
+}
+
+func newArgumentError(format string, args ...interface{}) error {
+	return &argumentError{message: fmt.Sprintf(format, args...)}
+}
+
+// hasCatchAll reports whether the path template ends with a "**" segment.
+func hasCatchAll(pathKey string) bool {
+	return strings.HasSuffix(pathKey, "/**")
+}
+
+// resolvePath fills the placeholders of the path template and appends it to basePath.
+// Placeholder values are escaped as a single segment. The catch-all value may span multiple segments
+// and is treated as an already escaped path.
+// It returns the escaped path.
+func resolvePath(basePath, pathKey string, values map[string]string, catchAll string) (string, error) {
+	segments := []string{strings.TrimSuffix(basePath, "/")}
+
+	for _, segment := range strings.Split(strings.TrimPrefix(pathKey, "/"), "/") {
+		if segment == "**" {
+			escaped, err := resolveCatchAll(catchAll)
+			if err != nil {
+				return "", err
+			}
+			segments = append(segments, escaped...)
+			continue
+		}
+
+		var err error
+		segment = pathPlaceholderRegexp.ReplaceAllStringFunc(segment, func(placeholder string) string {
+			name := strings.Trim(placeholder, "{}")
+			value, ok := values[name]
+			if !ok || value == "" {
+				err = newArgumentError("path argument %q is required", name)
+				return placeholder
+			}
+			if isTraversal(value) {
+				err = newArgumentError("path argument %q must not traverse directories: %q", name, value)
+				return placeholder
+			}
+			return url.PathEscape(value)
+		})
+		if err != nil {
+			return "", err
+		}
+		segments = append(segments, segment)
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+func resolveCatchAll(value string) ([]string, error) {
+	value = strings.Trim(value, "/")
+	if value == "" {
+		return nil, newArgumentError("argument %q is required", catchAllArgument)
+	}
+
+	var escaped []string
+	for _, segment := range strings.Split(value, "/") {
+		if segment == "" {
+			continue
+		}
+		if isTraversal(segment) {
+			return nil, newArgumentError("argument %q must not traverse directories: %q", catchAllArgument, value)
+		}
+		// keep segments that are already percent-encoded, such as "%2F", as they are
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segment = decoded
+		}
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+	return escaped, nil
+}
+
+// isTraversal reports whether the value contains a "." or ".." segment, even once percent-decoded.
+func isTraversal(value string) bool {
+	if decoded, err := url.PathUnescape(value); err == nil && decoded != value && isTraversal(decoded) {
+		return true
+	}
+	for _, segment := range strings.FieldsFunc(value, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return value == "." || value == ".."
+}
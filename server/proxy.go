@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// publicAddress is how clients reach the server through a reverse proxy, to advertise URLs they can use.
+type publicAddress struct {
+	basePath  string   // path prefix the server's endpoints are served under
+	publicURL *url.URL // URL clients use, such as https://gw.example.com/mcp/querypie. nil if not configured
+}
+
+func (s *Server) publicAddress() *publicAddress {
+	return &publicAddress{basePath: s.basePath, publicURL: s.publicURL}
+}
+
+// resolve turns a path served by this server into the URL clients should use. Without a public URL,
+// the scheme and host come from X-Forwarded-Proto and X-Forwarded-Host if the proxy sends them,
+// or else the path is kept relative, which clients resolve against the URL they connected to.
+func (p *publicAddress) resolve(r *http.Request, path string) string {
+	if p.publicURL != nil {
+		pathOnly, query, _ := strings.Cut(path, "?")
+		u := *p.publicURL
+		u.Path = strings.TrimSuffix(u.Path, "/") + strings.TrimPrefix(pathOnly, p.basePath)
+		u.RawPath = ""
+		u.RawQuery = query
+		return u.String()
+	}
+
+	host := forwardedValue(r.Header.Get("X-Forwarded-Host"))
+	if host == "" {
+		return path
+	}
+	scheme := forwardedValue(r.Header.Get("X-Forwarded-Proto"))
+	if scheme != "http" && scheme != "https" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + host + path
+}
+
+// forwardedValue returns the value set by the proxy closest to the client, as proxies append theirs to the list.
+func forwardedValue(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
+
+// wrapSSE rewrites the endpoint event of SSE connections, which tells clients where to post their messages.
+func (p *publicAddress) wrapSSE(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w = &endpointEventWriter{ResponseWriter: w, resolve: func(path string) string { return p.resolve(r, path) }}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var endpointEventPrefix = []byte("event: endpoint\ndata: ")
+
+// endpointEventWriter rewrites the message endpoint of the first event written to an SSE connection.
+type endpointEventWriter struct {
+	http.ResponseWriter
+	resolve func(path string) string
+	written bool
+}
+
+func (w *endpointEventWriter) Write(b []byte) (int, error) {
+	if w.written || !bytes.HasPrefix(b, endpointEventPrefix) {
+		w.written = true
+		return w.ResponseWriter.Write(b)
+	}
+	w.written = true
+
+	data := bytes.TrimRight(b[len(endpointEventPrefix):], "\r\n")
+	event := append([]byte(nil), endpointEventPrefix...)
+	event = append(event, w.resolve(string(data))...)
+	event = append(event, b[len(endpointEventPrefix)+len(data):]...)
+	if _, err := w.ResponseWriter.Write(event); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *endpointEventWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	sessionBucketIdleTimeout = 10 * time.Minute
+	inflightRetryAfter       = time.Second
+)
+
+// RateLimit is a token-bucket limit. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64 // requests per second
+	Burst int
+}
+
+// ParseRateLimit parses a limit in the form of "rate[:burst]" (e.g. "5" or "0.5:3").
+// If burst is omitted, it defaults to the rate rounded up.
+func ParseRateLimit(str string) (RateLimit, error) {
+	rateStr, burstStr, hasBurst := strings.Cut(strings.TrimSpace(str), ":")
+
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return RateLimit{}, fmt.Errorf("invalid rate: %q", rateStr)
+	}
+
+	burst := int(math.Max(1, math.Ceil(rate)))
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return RateLimit{}, fmt.Errorf("invalid burst: %q", burstStr)
+		}
+	}
+
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// RateLimitConfig configures the limits applied to tool calls before they reach QueryPie.
+type RateLimitConfig struct {
+	Global      RateLimit            // shared by every call
+	Session     RateLimit            // per MCP client session
+	Tool        RateLimit            // per tool, unless overridden in Tools
+	Tools       map[string]RateLimit // per tool overrides keyed by tool name
+	MaxInflight int                  // maximum number of concurrent upstream calls. 0 means unlimited
+}
+
+func (c RateLimitConfig) enabled() bool {
+	return c.Global.Enabled() || c.Session.Enabled() || c.Tool.Enabled() || len(c.Tools) > 0 || c.MaxInflight > 0
+}
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if !limit.Enabled() {
+		return nil
+	}
+	now := time.Now()
+	return &tokenBucket{
+		rate:     limit.Rate,
+		burst:    float64(limit.Burst),
+		tokens:   float64(limit.Burst),
+		last:     now,
+		lastUsed: now,
+	}
+}
+
+// take consumes a token. If none is available, it returns how long to wait until one is.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.lastUsed = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// refund gives back a token taken by a call that was rejected by another limit.
+func (b *tokenBucket) refund() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+func (b *tokenBucket) idleSince(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.lastUsed)
+}
+
+type rateLimiter struct {
+	config    RateLimitConfig
+	global    *tokenBucket
+	inflight  chan struct{}
+	mu        sync.Mutex
+	tools     map[string]*tokenBucket
+	sessions  map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if !config.enabled() {
+		return nil
+	}
+
+	l := &rateLimiter{
+		config:    config,
+		global:    newTokenBucket(config.Global),
+		tools:     make(map[string]*tokenBucket),
+		sessions:  make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+	if config.MaxInflight > 0 {
+		l.inflight = make(chan struct{}, config.MaxInflight)
+	}
+	return l
+}
+
+func (l *rateLimiter) toolBucket(name string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bucket, ok := l.tools[name]; ok {
+		return bucket
+	}
+	limit, ok := l.config.Tools[name]
+	if !ok {
+		limit = l.config.Tool
+	}
+	bucket := newTokenBucket(limit)
+	l.tools[name] = bucket
+	return bucket
+}
+
+func (l *rateLimiter) sessionBucket(ctx context.Context, now time.Time) *tokenBucket {
+	if !l.config.Session.Enabled() {
+		return nil
+	}
+	session := server.ClientSessionFromContext(ctx)
+	if session == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Sessions are never unregistered from here, so drop idle buckets from time to time
+	if now.Sub(l.lastPrune) > time.Minute {
+		for id, bucket := range l.sessions {
+			if bucket.idleSince(now) > sessionBucketIdleTimeout {
+				delete(l.sessions, id)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	bucket, ok := l.sessions[session.SessionID()]
+	if !ok {
+		bucket = newTokenBucket(l.config.Session)
+		l.sessions[session.SessionID()] = bucket
+	}
+	return bucket
+}
+
+// allow takes a token from every bucket that applies to the call, and returns them.
+// If any bucket is empty, the tokens already taken are refunded.
+func (l *rateLimiter) allow(ctx context.Context, toolName string) ([]*tokenBucket, string, time.Duration, bool) {
+	now := time.Now()
+
+	buckets := []struct {
+		scope  string
+		bucket *tokenBucket
+	}{
+		{"global", l.global},
+		{"session", l.sessionBucket(ctx, now)},
+		{"tool " + toolName, l.toolBucket(toolName)},
+	}
+
+	var taken []*tokenBucket
+	for _, b := range buckets {
+		if b.bucket == nil {
+			continue
+		}
+		if ok, wait := b.bucket.take(now); !ok {
+			refundTokens(taken)
+			return nil, b.scope, wait, false
+		}
+		taken = append(taken, b.bucket)
+	}
+	return taken, "", 0, true
+}
+
+func refundTokens(taken []*tokenBucket) {
+	for _, bucket := range taken {
+		bucket.refund()
+	}
+}
+
+type rateTokensKey struct{}
+
+// middleware takes the rate limit tokens of a call. It comes before the approval hook,
+// so an approved call is not rejected by them.
+func (l *rateLimiter) middleware(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if dryRunFromContext(ctx) {
+			return next(ctx, request)
+		}
+
+		// a call that would not get an in-flight slot now takes no token from the buckets
+		if l.inflight != nil && len(l.inflight) == cap(l.inflight) {
+			return l.rejectInflight(tool), nil
+		}
+
+		taken, scope, wait, ok := l.allow(ctx, tool.Tool.Name)
+		if !ok {
+			slog.Warn("• Tool call is rejected. Rate limit exceeded", "tool", tool.Tool.Name, "instance", tool.client.instance, "scope", scope)
+			return newBackoffResult(fmt.Sprintf("rate limit exceeded (%s)", scope), wait), nil
+		}
+
+		return next(context.WithValue(ctx, rateTokensKey{}, taken), request)
+	}
+}
+
+// inflightMiddleware holds an in-flight slot while the call runs. It comes after the approval hook,
+// so a call waiting for a verdict does not hold one. The tokens of a call it rejects are refunded.
+func (l *rateLimiter) inflightMiddleware(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if l.inflight == nil || dryRunFromContext(ctx) {
+			return next(ctx, request)
+		}
+
+		select {
+		case l.inflight <- struct{}{}:
+			defer func() { <-l.inflight }()
+		default:
+			taken, _ := ctx.Value(rateTokensKey{}).([]*tokenBucket)
+			refundTokens(taken)
+			return l.rejectInflight(tool), nil
+		}
+
+		return next(ctx, request)
+	}
+}
+
+func (l *rateLimiter) rejectInflight(tool operationTool) *mcp.CallToolResult {
+	slog.Warn("• Tool call is rejected. Too many concurrent requests", "tool", tool.Tool.Name, "instance", tool.client.instance, "max", l.config.MaxInflight)
+	return newBackoffResult(fmt.Sprintf("too many concurrent requests (max %d)", l.config.MaxInflight), inflightRetryAfter)
+}
+
+// newBackoffResult tells the model that the call was not sent and when it may retry.
+func newBackoffResult(reason string, wait time.Duration) *mcp.CallToolResult {
+	wait = max(100*time.Millisecond, (wait + 99*time.Millisecond).Truncate(100*time.Millisecond))
+
+	result := mcp.NewToolResultError(fmt.Sprintf(
+		"The request was not sent to QueryPie: %s. Back off and retry after %s.", reason, wait))
+	result.Meta = map[string]interface{}{
+		"retryAfterSeconds": wait.Seconds(),
+	}
+	return result
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Scopes of client tokens that select the toolset of the client.
+const (
+	scopeRead  = "querypie:read"  // read tools only
+	scopeWrite = "querypie:write" // read and mutating tools
+)
+
+// hasToolset reports whether the client's token carries any of the toolset scopes.
+func (i *clientIdentity) hasToolset() bool {
+	return i != nil && (containsString(i.Scopes, scopeRead) || containsString(i.Scopes, scopeWrite))
+}
+
+// canWrite reports whether the client may call mutating tools.
+// Clients without any toolset scope, such as those using static tokens, are not restricted.
+func (i *clientIdentity) canWrite() bool {
+	return !i.hasToolset() || containsString(i.Scopes, scopeWrite)
+}
+
+// scopeMiddleware rejects mutating calls of clients that are only allowed to read.
+func scopeMiddleware(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	if !tool.mutating() {
+		return next
+	}
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if !clientIdentityFromContext(ctx).canWrite() {
+			slog.Warn("• Tool call is rejected. The client has no write scope", "tool", tool.Tool.Name, "instance", tool.client.instance)
+			return mcp.NewToolResultError("This tool changes QueryPie and requires the " + scopeWrite + " scope."), nil
+		}
+		return next(ctx, request)
+	}
+}
+
+// addScopeHooks hides the tools a client cannot call from its tool list.
+func addScopeHooks(hooks *server.Hooks, tools []operationTool) {
+	mutating := make(map[string]bool, len(tools))
+	for _, tool := range tools {
+		mutating[tool.Tool.Name] = tool.mutating()
+	}
+
+	hooks.AddAfterListTools(func(ctx context.Context, id any, message *mcp.ListToolsRequest, result *mcp.ListToolsResult) {
+		if clientIdentityFromContext(ctx).canWrite() {
+			return
+		}
+		visible := result.Tools[:0]
+		for _, tool := range result.Tools {
+			if !mutating[tool.Name] {
+				visible = append(visible, tool)
+			}
+		}
+		result.Tools = visible
+	})
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,140 +27,293 @@ type Server struct {
 	transport      string
 	port           int
 	opts           []server.ServerOption
+	rateLimits     RateLimitConfig
+	dryRun         bool
+	approval       ApprovalConfig
+	writeWindow    WriteWindowConfig
+	inboundAuth    InboundAuthConfig
+	skipProbe      bool
+	downloadSpec   bool
+	openapi        string
+	cacheDir       string
+
+	apiKeyFile       string
+	apiKeyCommand    string
+	apiKeyCommandTTL time.Duration
+
+	separateWriteKey bool
+	writeAPIKey      string
+	writeAPIKeyFile  string
+
+	instances []InstanceConfig
+
+	identityHeader string
+
+	tls            TLSConfig
+	listenAddress  string
+	socketMode     os.FileMode
+	drainTimeout   time.Duration
+	health         HealthConfig
+	basePath       string
+	publicURL      *url.URL
+	allowedOrigins []string
+	toolTimeouts   ToolTimeouts
 }
 
-func NewServer(querypieAPIKey string, querypieURL string, transport string, port int, opts ...server.ServerOption) *Server {
-	return &Server{
+func NewServer(querypieAPIKey string, querypieURL string, transport string, port int, opts ...Option) *Server {
+	s := &Server{
 		querypieAPIKey: querypieAPIKey,
 		querypieURL:    querypieURL,
 		transport:      transport,
 		port:           port,
-		opts:           opts,
+		drainTimeout:   DefaultDrainTimeout,
+		toolTimeouts:   ToolTimeouts{Default: DefaultToolTimeout},
+		cacheDir:       DefaultCacheDir(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 func (s *Server) Start(ctx context.Context, noCache bool, versionStr string) error {
 	slog.Info("• Starting MCP Server for QueryPie")
 
-	// getting version from the querypie server
-	slog.Info("• Getting version from the QueryPie", "url", s.querypieURL)
-
-	var (
-		version *Version
-		err     error
-	)
-	if strings.TrimSpace(versionStr) == "" {
-		version, err = getVersion(s.querypieURL)
-		if err != nil {
-			return fmt.Errorf("failed to get version from %v: %w", s.querypieURL, err)
-		}
-		slog.Info(fmt.Sprintf("   ✔ QueryPie version is automatically resolved: %v", version.String()))
-	} else {
-		version, err = NewVersionFromString(strings.TrimSpace(versionStr))
-		if err != nil {
-			return fmt.Errorf("failed to parse version '%v': %w", strings.TrimSpace(versionStr), err)
-		}
-		slog.Info(fmt.Sprintf("   ✔ QueryPie version is manually set: %v", version.String()))
+	instances, err := s.newInstances(ctx, versionStr)
+	if err != nil {
+		return err
 	}
 
-	slog.Info("• Loading OpenAPI specification")
-
-	var spec []byte
-
-	if noCache {
-		slog.Info("   • OpenAPI specification is not cached. Downloading new one")
-		spec, err = downloadOpenAPIFile(*version, 0)
+	var tools []operationTool
+	for _, instance := range instances {
+		instanceTools, err := s.loadInstance(ctx, instance, noCache)
 		if err != nil {
-			return err
-		}
-		slog.Info("   ✔ OpenAPI specification is downloaded")
-	} else {
-		cachedOpenAPIFile, err := loadCachedOpenAPI(*version)
-		if err != nil {
-			if errors.Is(err, ErrCacheFileOutdated) {
-				slog.Info("   • OpenAPI specification is outdated. Downloading new one")
-			} else if os.IsNotExist(err) {
-				slog.Info("   • OpenAPI specification is not cached. Downloading new one")
-			} else {
-				slog.Debug("   • Failed to load cached openapi.yaml. Downloading new one", "error", err)
-			}
-
-			spec, err = downloadOpenAPIFile(*version, 0)
-			if err != nil {
-				return err
+			if instance.name != "" {
+				return fmt.Errorf("failed to load instance %s: %w", instance.name, err)
 			}
-
-			err = writeOpenAPIToCache(*version, spec)
-			if err != nil {
-				slog.Debug("failed to write openapi.yaml cache", "error", err)
-			}
-
-			slog.Info("   ✔ OpenAPI specification is downloaded")
-		} else {
-			spec = cachedOpenAPIFile
-			slog.Info("   ✔ OpenAPI specification is loaded from cache")
+			return err
 		}
+		tools = append(tools, instanceTools...)
 	}
-
-	doc, err := libopenapi.NewDocument(spec)
-	if err != nil {
-		return fmt.Errorf("error parsing OpenAPI spec: %v", err)
+	if len(instances) > 1 {
+		slog.Info(fmt.Sprintf("✔ %d tools are loaded from %d instances", len(tools), len(instances)))
 	}
 
-	model, errs := doc.BuildV3Model()
-	if len(errs) > 0 {
-		return fmt.Errorf("error building OpenAPI model: %v", errors.Join(errs...))
+	// calls running when the server is stopped are let finish, and come first so new calls are rejected at once
+	drainer := newDrainer()
+	cancellations := newCancellations()
+	middlewares := []toolMiddleware{drainer.middleware, cancellations.middleware}
+	attribution := newIdentityAttribution(s.identityHeader)
+	if attribution != nil {
+		slog.Info(fmt.Sprintf("   ✔ The user of each tool call is sent to QueryPie in %s", s.identityHeader))
+		middlewares = append(middlewares, attribution.middleware)
 	}
-
-	slog.Info("   • Loading tools from OpenAPI specification")
-	tools, err := parseToolsFromOpenAPI(ctx, s.querypieAPIKey, s.querypieURL, model.Model)
-	if err != nil {
-		return fmt.Errorf("error parsing tools from OpenAPI: %w", err)
+	if s.inboundAuth.enabled() {
+		middlewares = append(middlewares, scopeMiddleware)
 	}
-	slog.Info(fmt.Sprintf("   ✔ %d tools are loaded", len(tools)))
+	middlewares = append(middlewares, dryRunMiddleware(s.dryRun))
+	if s.dryRun {
+		slog.Info("   ✔ Dry run is enabled. No request is sent to QueryPie")
+	}
+	window := newWriteWindow(s.writeWindow)
+	if window != nil {
+		slog.Info(fmt.Sprintf("   ✔ Mutating tools are disabled until a write window of %s is opened", s.writeWindow.Duration))
+		middlewares = append(middlewares, window.middleware)
+	}
+	// the rate limits come before the approval hook, and the in-flight cap after it
+	limiter := newRateLimiter(s.rateLimits)
+	if limiter != nil {
+		slog.Info("   ✔ Rate limits are enabled")
+		middlewares = append(middlewares, limiter.middleware)
+	}
+	if approver := newApprover(s.approval); approver != nil {
+		slog.Info("   ✔ Approval hook is enabled for mutating tools")
+		middlewares = append(middlewares, approver.middleware)
+	}
+	if limiter != nil {
+		middlewares = append(middlewares, limiter.inflightMiddleware)
+	}
+	// the timeout covers only the request to QueryPie, not the wait for approval or a rate limit
+	middlewares = append(middlewares, timeoutMiddleware(s.toolTimeouts))
+	tools = applyMiddlewares(tools, middlewares...)
 
 	var opts []server.ServerOption
 	opts = append(opts, server.WithLogging())
+	if window != nil {
+		opts = append(opts, server.WithToolCapabilities(true))
+	}
+	hooks := &server.Hooks{}
+	cancellations.addHooks(hooks)
+	if s.inboundAuth.enabled() {
+		addScopeHooks(hooks, tools)
+	}
+	if attribution != nil {
+		attribution.addHooks(hooks)
+	}
+	opts = append(opts, server.WithHooks(hooks))
 	opts = append(opts, s.opts...)
 	srv := server.NewMCPServer("mcp-querypie", consts.Version, opts...)
+	srv.AddNotificationHandler(methodCancelled, cancellations.handleNotification)
 
-	srv.AddTools(tools...)
+	if window != nil {
+		window.register(srv, tools)
+		window.watch(ctx)
+	} else {
+		srv.AddTools(serverTools(tools)...)
+	}
 
 	switch s.transport {
 	case "stdio":
 		slog.Info(fmt.Sprintf("✔ MCP Server is started with %s", s.transport))
 		stdioSrv := server.NewStdioServer(srv)
-		return stdioSrv.Listen(ctx, os.Stdin, os.Stdout)
-	case "sse":
-		slog.Info(fmt.Sprintf("✔ MCP Server with %s is now listening on :%d", s.transport, s.port))
-		sseSrv := server.NewSSEServer(srv)
-		errChan := make(chan error)
+
+		// the running call must not be cancelled by the signal, so the server is stopped only after draining
+		serveCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		defer cancel()
+		errChan := make(chan error, 1)
 		go func() {
-			err := sseSrv.Start(fmt.Sprintf(":%d", s.port))
-			if err != nil {
-				errChan <- err
-			}
+			errChan <- stdioSrv.Listen(serveCtx, cancellations.filterStdin(os.Stdin), os.Stdout)
 		}()
 
 		select {
 		case <-ctx.Done():
 			slog.Info("• Shutting down MCP Server ...")
-			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-			defer cancel()
-			err := sseSrv.Shutdown(ctx)
+			s.drain(drainer)
+			cancel()
+			<-errChan
 			slog.Info("• MCP Server is shutdown")
-			if errors.Is(err, context.DeadlineExceeded) {
-				return nil
-			}
-			return err
+			return nil
 		case err := <-errChan:
 			return err
 		}
+	case "sse", "http":
+		return s.serveHTTP(ctx, srv, window, drainer, s.newHealth(instances, tools, drainer), instances[0].readKeys != nil)
 	default:
 		return fmt.Errorf("unsupported transport: %s", s.transport)
 	}
 }
 
+// drain waits for the running tool calls to finish, for at most the drain timeout.
+func (s *Server) drain(d *drainer) {
+	slog.Info("• Waiting for running tool calls to finish ...", "timeout", s.drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	if running := d.drain(ctx); running > 0 {
+		slog.Warn(fmt.Sprintf("• %d tool calls did not finish in time. They are cancelled", running))
+	}
+}
+
+// loadInstance loads the specification of the instance's QueryPie version, and returns its tools.
+func (s *Server) loadInstance(ctx context.Context, instance *instance, noCache bool) ([]operationTool, error) {
+	if instance.name != "" {
+		slog.Info(fmt.Sprintf("• Loading the instance %s", instance.name))
+	}
+
+	var spec []byte
+	var err error
+	if instance.openapi != "" {
+		// the given specification is used whatever the version of QueryPie
+		spec, err = readSpec(ctx, instance)
+	} else {
+		var version *Version
+		if version, err = resolveVersion(ctx, instance); err == nil {
+			spec, err = s.loadSpec(ctx, instance, *version, noCache)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := libopenapi.NewDocument(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing OpenAPI spec: %v", err)
+	}
+
+	model, errs := doc.BuildV3Model()
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("error building OpenAPI model: %v", errors.Join(errs...))
+	}
+
+	slog.Info("   • Loading tools from OpenAPI specification")
+	client, err := newQuerypieClient(instance.readKeys, instance.writeKeys, instance.url)
+	if err != nil {
+		return nil, err
+	}
+	client.instance = instance.name
+
+	tools, err := parseToolsFromOpenAPI(ctx, client, model.Model)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tools from OpenAPI: %w", err)
+	}
+	slog.Info(fmt.Sprintf("   ✔ %d tools are loaded", len(tools)))
+
+	// with per-client keys there is no key to probe, and a dry run must not reach QueryPie
+	if instance.readKeys != nil && !s.skipProbe && !s.dryRun {
+		slog.Info("• Checking the QueryPie API key")
+		caps, err := detectCapabilities(ctx, client, tools)
+		if err != nil {
+			return nil, err
+		}
+		if filtered := caps.filter(tools); len(filtered) != len(tools) {
+			slog.Info(fmt.Sprintf("   ✔ %d tools are skipped", len(tools)-len(filtered)))
+			tools = filtered
+		}
+		if instance.separateWriteKey && instance.writeKeys != nil {
+			if _, err := verifyAPIKey(ctx, client, instance.writeKeys, "QueryPie write API key"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if instance.separateWriteKey {
+		if instance.writeKeys == nil {
+			tools = readTools(tools)
+			slog.Info(fmt.Sprintf("   ✔ Mutating tools are disabled without a write API key. %d read tools are left", len(tools)))
+		} else {
+			slog.Info("   ✔ Mutating tools are sent with the write API key")
+		}
+	}
+
+	if instance.name != "" {
+		for i := range tools {
+			tools[i].Tool.Name = instance.toolName(tools[i].Tool.Name)
+			tools[i].Tool.Description = fmt.Sprintf("[%s] %s", instance.name, tools[i].Tool.Description)
+		}
+	}
+
+	if waiting := jobTools(tools); len(waiting) > 0 {
+		slog.Info(fmt.Sprintf("   ✔ %d tools waiting for QueryPie jobs are added", len(waiting)))
+		tools = append(tools, waiting...)
+	}
+	return tools, nil
+}
+
+// resolveVersion returns the version of QueryPie set for the instance, or else detected from QueryPie.
+func resolveVersion(ctx context.Context, instance *instance) (*Version, error) {
+	// getting version from the querypie server
+	slog.Info("• Getting version from the QueryPie", "url", instance.url)
+
+	var version *Version
+	var err error
+	versionStr := instance.version
+	if strings.TrimSpace(versionStr) == "" {
+		version, err = GetVersion(ctx, instance.url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get version from %v: %w", instance.url, err)
+		}
+		slog.Info(fmt.Sprintf("   ✔ QueryPie version is automatically resolved: %v", version.String()))
+	} else {
+		version, err = NewVersionFromString(strings.TrimSpace(versionStr))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse version '%v': %w", strings.TrimSpace(versionStr), err)
+		}
+		slog.Info(fmt.Sprintf("   ✔ QueryPie version is manually set: %v", version.String()))
+	}
+
+	instance.version = version.String()
+	return version, nil
+}
+
 func NewVersionFromString(str string) (*Version, error) {
 	re := regexp.MustCompile(`^v?([0-9]+).([0-9]+).([0-9]+)`)
 	matches := re.FindStringSubmatch(str)
@@ -182,13 +337,30 @@ func (v Version) String() string {
 	return fmt.Sprintf("v%s.%s.%s", v.Major, v.Minor, v.Patch)
 }
 
-func getVersion(querypieURL string) (*Version, error) {
+// Compare returns -1, 0 or 1 if v is older than, the same as or newer than other.
+func (v Version) Compare(other Version) int {
+	for _, parts := range [][2]string{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		a, _ := strconv.Atoi(parts[0])
+		b, _ := strconv.Atoi(parts[1])
+		if c := cmp.Compare(a, b); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// GetVersion asks QueryPie its version.
+func GetVersion(ctx context.Context, querypieURL string) (*Version, error) {
 	versionURL, err := url.JoinPath(querypieURL, "/version")
 	if err != nil {
 		return nil, fmt.Errorf("malformed querypie URL: %w", err)
 	}
 
-	response, err := http.Get(versionURL)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, versionURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("malformed querypie URL: %w", err)
+	}
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get version from %s: %w", querypieURL, err)
 	}
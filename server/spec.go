@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/querypie/querypie-mcp-server/openapis"
+)
+
+// SpecResolution is the bundled OpenAPI specification used for a QueryPie version.
+type SpecResolution struct {
+	QueryPie Version // version of QueryPie
+	Spec     Version // version of the specification
+	Newer    bool    // QueryPie is newer than every bundled specification
+	Older    bool    // QueryPie is older than every bundled specification, so the oldest one is used
+}
+
+// Exact reports whether the specification is the one of the QueryPie version.
+func (r SpecResolution) Exact() bool {
+	return r.QueryPie.Compare(r.Spec) == 0
+}
+
+func (r SpecResolution) String() string {
+	switch {
+	case r.Exact():
+		return fmt.Sprintf("QueryPie %s uses its own specification", r.QueryPie)
+	case r.Newer:
+		return fmt.Sprintf("QueryPie %s uses the specification of %s, the newest bundled one", r.QueryPie, r.Spec)
+	case r.Older:
+		return fmt.Sprintf("QueryPie %s uses the specification of %s, the oldest bundled one", r.QueryPie, r.Spec)
+	default:
+		return fmt.Sprintf("QueryPie %s uses the specification of %s, the closest older one", r.QueryPie, r.Spec)
+	}
+}
+
+// SpecVersions returns the versions of the bundled specifications, from the oldest.
+func SpecVersions() []Version {
+	var versions []Version
+	for _, name := range openapis.Versions() {
+		if version, err := NewVersionFromString(name); err == nil {
+			versions = append(versions, *version)
+		}
+	}
+	slices.SortFunc(versions, Version.Compare)
+	return versions
+}
+
+// ResolveSpecVersion returns the bundled specification to use for a QueryPie version: its own,
+// or else the one of the closest older version, which lacks only the endpoints added since.
+func ResolveSpecVersion(version Version) SpecResolution {
+	versions := SpecVersions()
+	resolution := SpecResolution{QueryPie: version, Spec: versions[0], Older: true}
+	for _, spec := range versions {
+		if spec.Compare(version) > 0 {
+			break
+		}
+		resolution.Spec = spec
+		resolution.Older = false
+	}
+	resolution.Newer = version.Compare(versions[len(versions)-1]) > 0
+	return resolution
+}
+
+// loadSpec returns the OpenAPI specification of the QueryPie version. Without a bundled one,
+// it is downloaded if downloading is enabled, or else the closest bundled one is used.
+func (s *Server) loadSpec(ctx context.Context, instance *instance, version Version, noCache bool) ([]byte, error) {
+	slog.Info("• Loading OpenAPI specification")
+
+	resolution := ResolveSpecVersion(version)
+	if !resolution.Exact() && s.downloadSpec {
+		spec, err := s.fetchSpec(ctx, instance, version, noCache)
+		if err == nil {
+			return spec, nil
+		}
+		slog.Warn("   • Failed to download the OpenAPI specification. The closest bundled one is used", "error", err)
+	}
+
+	switch {
+	case resolution.Exact():
+	case resolution.Newer:
+		hint := "Use --download-openapi or --openapi for its own"
+		if s.downloadSpec {
+			hint = "Use --openapi for its own"
+		}
+		slog.Warn(fmt.Sprintf("   • QueryPie %s is newer than every bundled OpenAPI specification. The one of %s is used, "+
+			"and lacks the endpoints added since. %s", version, resolution.Spec, hint))
+	case resolution.Older:
+		slog.Warn(fmt.Sprintf("   • QueryPie %s is older than every bundled OpenAPI specification. The one of %s is used, "+
+			"and may have endpoints it does not serve", version, resolution.Spec))
+	default:
+		slog.Info(fmt.Sprintf("   • %s", resolution))
+	}
+
+	spec, ok := openapis.Lookup(resolution.Spec.String())
+	if !ok {
+		return nil, fmt.Errorf("the OpenAPI specification of %s is not bundled", resolution.Spec)
+	}
+	instance.specSource = "embedded"
+	slog.Info(fmt.Sprintf("   ✔ OpenAPI specification of %s is loaded from the binary", resolution.Spec))
+	return spec, nil
+}
+
+// fetchSpec returns the cached specification of the version, or else downloads it.
+// An outdated cached one is still used if the download fails.
+func (s *Server) fetchSpec(ctx context.Context, instance *instance, version Version, noCache bool) ([]byte, error) {
+	if noCache {
+		slog.Info("   • OpenAPI specification is not cached. Downloading new one")
+		spec, err := downloadOpenAPIFile(ctx, version)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("   ✔ OpenAPI specification is downloaded")
+		instance.specSource = "download"
+		return spec, nil
+	}
+
+	dir := cacheDir(s.cacheDir, instance.name, version)
+	cached, outdated, err := loadCachedOpenAPI(dir)
+	switch {
+	case err == nil && !outdated:
+		instance.specSource = "cache"
+		slog.Info("   ✔ OpenAPI specification is loaded from cache", "dir", dir)
+		return cached, nil
+	case err == nil:
+		slog.Info("   • OpenAPI specification is outdated. Downloading new one")
+	case errors.Is(err, fs.ErrNotExist):
+		slog.Info("   • OpenAPI specification is not cached. Downloading new one")
+	default:
+		slog.Warn("   • Cached OpenAPI specification is invalid. Downloading new one", "dir", dir, "error", err)
+	}
+
+	spec, err := downloadOpenAPIFile(ctx, version)
+	if err != nil {
+		if cached == nil {
+			return nil, err
+		}
+		slog.Warn("   • Failed to download the OpenAPI specification. The outdated cached one is used", "error", err)
+		instance.specSource = "cache"
+		return cached, nil
+	}
+
+	if err := writeOpenAPIToCache(dir, spec); err != nil {
+		slog.Warn("   • Failed to cache the OpenAPI specification", "dir", dir, "error", err)
+	}
+
+	slog.Info("   ✔ OpenAPI specification is downloaded")
+	instance.specSource = "download"
+	return spec, nil
+}
+
+// readSpec reads the OpenAPI specification of the instance from a file path, a file:// URL or an https:// URL,
+// such as the api-docs endpoint of QueryPie. It may be in YAML or JSON.
+func readSpec(ctx context.Context, instance *instance) ([]byte, error) {
+	slog.Info("• Loading OpenAPI specification", "openapi", instance.openapi)
+
+	spec, err := readSpecSource(ctx, instance.openapi)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the OpenAPI specification %s: %w", instance.openapi, err)
+	}
+	instance.specSource = instance.openapi
+	slog.Info("   ✔ OpenAPI specification is loaded")
+	return spec, nil
+}
+
+func readSpecSource(ctx context.Context, source string) ([]byte, error) {
+	u, err := url.Parse(source)
+	if err != nil || len(u.Scheme) < 2 { // a path, or a Windows path such as C:\specs\openapi.yaml
+		return os.ReadFile(source)
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("file URL of another host: %s", u.Host)
+		}
+		return os.ReadFile(filepath.FromSlash(u.Path))
+	case "https":
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{Timeout: specDownloadTimeout}
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status: %s", response.Status)
+		}
+		return readSpecBody(response.Body)
+	case "http":
+		// the specification decides which requests are sent with the API key, so it is not read in plain text
+		return nil, errors.New("http:// URLs are not supported. use an https:// URL, or download the specification to a file")
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s. use a path, a file:// or an https:// URL", u.Scheme)
+	}
+}
@@ -0,0 +1,693 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const (
+	streamableEndpoint = "/mcp"
+	mcpSessionIDHeader = "Mcp-Session-Id"
+
+	streamableSessionIdleTimeout = 30 * time.Minute
+	streamableMaxSessions        = 1000 // sessions open at once, so clients cannot exhaust memory by initializing
+	streamableEventLogSize       = 1000 // events kept per session for resuming streams
+	streamableKeepAliveInterval  = 30 * time.Second
+	streamableMaxMessageSize     = 4 << 20
+
+	standaloneStream = "0" // the stream of GET requests, carrying messages unrelated to any request
+)
+
+// streamableServer serves MCP over the Streamable HTTP transport: a single endpoint
+// receiving messages by POST, answering with JSON or an SSE stream, and streaming
+// server messages to GET requests. Streams can be resumed with Last-Event-ID.
+type streamableServer struct {
+	srv            *server.MCPServer
+	contextFunc    server.SSEContextFunc
+	ctx            context.Context // cancels running requests on shutdown
+	allowedOrigins map[string]bool // origins of browser pages allowed besides localhost, as scheme://host[:port]
+
+	mu       sync.Mutex
+	sessions map[string]*streamableSession
+}
+
+func newStreamableServer(ctx context.Context, srv *server.MCPServer, contextFunc server.SSEContextFunc, allowedOrigins []string) *streamableServer {
+	h := &streamableServer{
+		srv:            srv,
+		contextFunc:    contextFunc,
+		ctx:            ctx,
+		allowedOrigins: make(map[string]bool),
+		sessions:       make(map[string]*streamableSession),
+	}
+	for _, origin := range allowedOrigins {
+		if origin, ok := normalizeOrigin(origin); ok {
+			h.allowedOrigins[origin] = true
+		}
+	}
+	go h.reapIdleSessions()
+	return h
+}
+
+func (h *streamableServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && !h.originAllowed(origin) {
+		slog.Warn("• MCP request from a page of another origin is rejected", "origin", origin, "remote", r.RemoteAddr)
+		http.Error(w, "Forbidden. Origin is not allowed", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		h.handlePost(w, r)
+	case http.MethodGet:
+		h.handleGet(w, r)
+	case http.MethodDelete:
+		h.handleDelete(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// originAllowed reports whether a browser page of the origin may call the endpoint. Other pages are rejected,
+// so a site that rebinds its DNS name to this server cannot reach it. Clients other than browsers send no Origin.
+func (h *streamableServer) originAllowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	origin, ok := normalizeOrigin(origin)
+	return ok && h.allowedOrigins[origin]
+}
+
+// normalizeOrigin returns the scheme://host[:port] of a URL.
+func normalizeOrigin(origin string) (string, bool) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), true
+}
+
+// incomingMessage is a JSON-RPC message sent by the client.
+type incomingMessage struct {
+	raw    json.RawMessage
+	Method string          `json:"method"`
+	ID     json.RawMessage `json:"id"`
+	Params struct {
+		Meta struct {
+			ProgressToken interface{} `json:"progressToken"`
+		} `json:"_meta"`
+	} `json:"params"`
+}
+
+// isRequest reports whether the message expects a response. Notifications and responses do not.
+func (m incomingMessage) isRequest() bool {
+	return m.Method != "" && len(m.ID) > 0 && string(m.ID) != "null"
+}
+
+func parseMessages(body []byte) ([]incomingMessage, bool, error) {
+	body = bytes.TrimSpace(body)
+	var raws []json.RawMessage
+	batch := len(body) > 0 && body[0] == '['
+	if batch {
+		if err := json.Unmarshal(body, &raws); err != nil {
+			return nil, false, err
+		}
+	} else {
+		raws = []json.RawMessage{body}
+	}
+
+	messages := make([]incomingMessage, len(raws))
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &messages[i]); err != nil {
+			return nil, false, err
+		}
+		messages[i].raw = raw
+	}
+	return messages, batch, nil
+}
+
+func (h *streamableServer) handlePost(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, streamableMaxMessageSize))
+	if err != nil {
+		http.Error(w, "Failed to read the request body", http.StatusBadRequest)
+		return
+	}
+	messages, batch, err := parseMessages(body)
+	if err != nil || len(messages) == 0 {
+		writeJSONRPCError(w, http.StatusBadRequest, mcp.PARSE_ERROR, "Parse error")
+		return
+	}
+
+	initialize := false
+	requests := 0
+	for _, message := range messages {
+		if message.Method == string(mcp.MethodInitialize) {
+			initialize = true
+		}
+		if message.isRequest() {
+			requests++
+		}
+	}
+
+	var session *streamableSession
+	if initialize {
+		if len(messages) > 1 {
+			writeJSONRPCError(w, http.StatusBadRequest, mcp.INVALID_REQUEST, "initialize must not be batched")
+			return
+		}
+		session, err = h.newSession(r.Context())
+		if errors.Is(err, errTooManySessions) {
+			slog.Warn("• MCP session is rejected. Too many sessions", "max", streamableMaxSessions)
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Too many sessions", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create a session", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		var ok bool
+		if session, ok = h.session(w, r); !ok {
+			return
+		}
+	}
+	w.Header().Set(mcpSessionIDHeader, session.id)
+
+	if requests == 0 {
+		// notifications and responses only. the server sends no requests, so responses are dropped
+		ctx := h.messageContext(r.Context(), session, r)
+		for _, message := range messages {
+			if message.Method != "" {
+				h.srv.HandleMessage(ctx, message.raw)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if !accepts(r, "text/event-stream") {
+		h.respondJSON(w, r, session, messages, batch)
+		return
+	}
+
+	// The requests keep running if the client disconnects, so it can resume the stream to get the responses
+	streamID := session.openStream()
+	for _, message := range messages {
+		if token := message.Params.Meta.ProgressToken; token != nil {
+			session.routeProgress(token, streamID)
+		}
+	}
+	ctx, cancel := context.WithCancel(h.messageContext(context.WithoutCancel(r.Context()), session, r))
+	stop := context.AfterFunc(h.ctx, cancel)
+	go func() {
+		defer stop()
+		defer cancel()
+		defer session.closeStream(streamID)
+		var wg sync.WaitGroup
+		for _, message := range messages {
+			if !message.isRequest() {
+				h.srv.HandleMessage(ctx, message.raw)
+				continue
+			}
+			wg.Add(1)
+			go func(message incomingMessage) {
+				defer wg.Done()
+				if response := h.srv.HandleMessage(ctx, message.raw); response != nil {
+					session.publishMessage(streamID, response)
+				}
+			}(message)
+		}
+		wg.Wait()
+	}()
+
+	h.serveStream(w, r, session, streamID, 0)
+}
+
+// respondJSON handles the requests, and writes their responses in a single JSON body.
+func (h *streamableServer) respondJSON(w http.ResponseWriter, r *http.Request, session *streamableSession, messages []incomingMessage, batch bool) {
+	ctx := h.messageContext(r.Context(), session, r)
+	responses := make([]mcp.JSONRPCMessage, 0, len(messages))
+	for _, message := range messages {
+		if response := h.srv.HandleMessage(ctx, message.raw); response != nil && message.isRequest() {
+			responses = append(responses, response)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if batch {
+		_ = json.NewEncoder(w).Encode(responses)
+	} else {
+		_ = json.NewEncoder(w).Encode(responses[0])
+	}
+}
+
+// handleGet opens the standalone stream of the session, or resumes a stream after Last-Event-ID.
+func (h *streamableServer) handleGet(w http.ResponseWriter, r *http.Request) {
+	if !accepts(r, "text/event-stream") {
+		http.Error(w, "Not acceptable. Accept text/event-stream", http.StatusNotAcceptable)
+		return
+	}
+	session, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+
+	streamID, after := standaloneStream, session.lastEventID()
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		var err error
+		if streamID, after, err = parseEventID(lastEventID); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set(mcpSessionIDHeader, session.id)
+	h.serveStream(w, r, session, streamID, after)
+}
+
+func (h *streamableServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+	h.closeSession(session)
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveStream writes the events of the stream after the given event ID, until the stream ends.
+func (h *streamableServer) serveStream(w http.ResponseWriter, r *http.Request, session *streamableSession, streamID string, after uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	session.attach()
+	defer session.detach()
+
+	keepAlive := time.NewTicker(streamableKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		events, ended, changed := session.eventsAfter(streamID, after)
+		for _, event := range events {
+			fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", formatEventID(event.stream, event.id), event.data)
+			after = event.id
+		}
+		flusher.Flush()
+		if ended {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-session.closed:
+			return
+		}
+	}
+}
+
+func (h *streamableServer) messageContext(ctx context.Context, session *streamableSession, r *http.Request) context.Context {
+	ctx = h.srv.WithContext(ctx, session)
+	if h.contextFunc != nil {
+		ctx = h.contextFunc(ctx, r)
+	}
+	return ctx
+}
+
+// session returns the session of the request, or responds with an error.
+func (h *streamableServer) session(w http.ResponseWriter, r *http.Request) (*streamableSession, bool) {
+	id := r.Header.Get(mcpSessionIDHeader)
+	if id == "" {
+		http.Error(w, "Bad request. Mcp-Session-Id header is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	h.mu.Lock()
+	session, ok := h.sessions[id]
+	h.mu.Unlock()
+	if ok && session.owner != sessionOwner(r.Context()) {
+		// answered like an unknown session, so session IDs of other clients cannot be probed
+		slog.Warn("• MCP request to the session of another client is rejected", "remote", r.RemoteAddr)
+		ok = false
+	}
+	if !ok {
+		// the client must start a new session with initialize
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, false
+	}
+	session.touch()
+	return session, true
+}
+
+var errTooManySessions = errors.New("too many sessions")
+
+func (h *streamableServer) newSession(ctx context.Context) (*streamableSession, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	session := newStreamableSession(hex.EncodeToString(id))
+	session.owner = sessionOwner(ctx)
+
+	h.mu.Lock()
+	if len(h.sessions) >= streamableMaxSessions {
+		h.mu.Unlock()
+		return nil, errTooManySessions
+	}
+	h.sessions[session.id] = session
+	h.mu.Unlock()
+
+	if err := h.srv.RegisterSession(ctx, session); err != nil {
+		h.mu.Lock()
+		delete(h.sessions, session.id)
+		h.mu.Unlock()
+		return nil, err
+	}
+	go session.forwardNotifications()
+	return session, nil
+}
+
+// sessionOwner is the authenticated client of a request, which must be the same for every request of a session.
+// It is empty without client authentication.
+func sessionOwner(ctx context.Context) string {
+	identity := clientIdentityFromContext(ctx)
+	if identity == nil {
+		return ""
+	}
+	return identity.Method + ":" + identity.Subject
+}
+
+func (h *streamableServer) closeSession(session *streamableSession) {
+	h.mu.Lock()
+	delete(h.sessions, session.id)
+	h.mu.Unlock()
+	h.srv.UnregisterSession(session.id)
+	session.close()
+}
+
+// close ends every session and its streams.
+func (h *streamableServer) close() {
+	h.mu.Lock()
+	sessions := make([]*streamableSession, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
+	}
+	h.mu.Unlock()
+
+	for _, session := range sessions {
+		h.closeSession(session)
+	}
+}
+
+func (h *streamableServer) reapIdleSessions() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			h.mu.Lock()
+			var idle []*streamableSession
+			for _, session := range h.sessions {
+				if session.idleSince(time.Now()) > streamableSessionIdleTimeout {
+					idle = append(idle, session)
+				}
+			}
+			h.mu.Unlock()
+
+			for _, session := range idle {
+				slog.Debug("closing idle MCP session", "session", session.id)
+				h.closeSession(session)
+			}
+		}
+	}
+}
+
+// streamEvent is a message sent to the client on one of the session's streams.
+type streamEvent struct {
+	id     uint64
+	stream string
+	data   []byte
+}
+
+// streamableSession keeps the recent events of every stream of a client, so streams can be resumed.
+type streamableSession struct {
+	id            string
+	owner         string // the authenticated client that created the session
+	notifications chan mcp.JSONRPCNotification
+	initialized   atomic.Bool
+	closed        chan struct{}
+	closeOnce     sync.Once
+
+	mu         sync.Mutex
+	seq        uint64
+	streams    uint64
+	events     []streamEvent
+	ended      map[string]bool   // POST streams whose responses are all sent
+	progress   map[string]string // progress token, by progressTokenKey, to the stream of its request
+	changed    chan struct{}     // closed and replaced whenever an event is added
+	attached   int
+	lastActive time.Time
+}
+
+func newStreamableSession(id string) *streamableSession {
+	return &streamableSession{
+		id:            id,
+		notifications: make(chan mcp.JSONRPCNotification, 100),
+		closed:        make(chan struct{}),
+		ended:         make(map[string]bool),
+		progress:      make(map[string]string),
+		changed:       make(chan struct{}),
+		lastActive:    time.Now(),
+	}
+}
+
+func (s *streamableSession) SessionID() string {
+	return s.id
+}
+
+func (s *streamableSession) NotificationChannel() chan<- mcp.JSONRPCNotification {
+	return s.notifications
+}
+
+func (s *streamableSession) Initialize() {
+	s.initialized.Store(true)
+}
+
+func (s *streamableSession) Initialized() bool {
+	return s.initialized.Load()
+}
+
+// forwardNotifications sends progress notifications on the stream of their request, and the others on the standalone stream.
+func (s *streamableSession) forwardNotifications() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case notification := <-s.notifications:
+			streamID := standaloneStream
+			if notification.Method == "notifications/progress" {
+				token := progressTokenKey(notification.Params.AdditionalFields["progressToken"])
+				s.mu.Lock()
+				if id, ok := s.progress[token]; ok {
+					streamID = id
+				}
+				s.mu.Unlock()
+			}
+			s.publishMessage(streamID, notification)
+		}
+	}
+}
+
+func (s *streamableSession) publishMessage(streamID string, message interface{}) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("failed to marshal MCP message", "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.events = append(s.events, streamEvent{id: s.seq, stream: streamID, data: data})
+	if len(s.events) > streamableEventLogSize {
+		s.events = s.events[len(s.events)-streamableEventLogSize:]
+	}
+	s.notifyLocked()
+}
+
+func (s *streamableSession) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// eventsAfter returns the events of the stream after the given ID, whether the stream has ended,
+// and a channel closed when there may be more.
+func (s *streamableSession) eventsAfter(streamID string, after uint64) ([]streamEvent, bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []streamEvent
+	for _, event := range s.events {
+		if event.stream == streamID && event.id > after {
+			events = append(events, event)
+		}
+	}
+	return events, s.ended[streamID], s.changed
+}
+
+func (s *streamableSession) lastEventID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+func (s *streamableSession) openStream() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams++
+	return strconv.FormatUint(s.streams, 10)
+}
+
+func (s *streamableSession) routeProgress(token interface{}, streamID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress[progressTokenKey(token)] = streamID
+}
+
+// progressTokenKey identifies a progress token by its JSON value, so the number 1 and the string "1" differ.
+func progressTokenKey(token interface{}) string {
+	key, _ := json.Marshal(token)
+	return string(key)
+}
+
+// closeStream marks the POST stream as ended once all its responses are published.
+func (s *streamableSession) closeStream(streamID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended[streamID] = true
+	// streams this old cannot be resumed anymore, their events are gone
+	if len(s.ended) > streamableEventLogSize {
+		for id := range s.ended {
+			if n, _ := strconv.ParseUint(id, 10, 64); n+streamableEventLogSize < s.streams {
+				delete(s.ended, id)
+			}
+		}
+	}
+	for token, id := range s.progress {
+		if id == streamID {
+			delete(s.progress, token)
+		}
+	}
+	s.notifyLocked()
+}
+
+func (s *streamableSession) attach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attached++
+	s.lastActive = time.Now()
+}
+
+func (s *streamableSession) detach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attached--
+	s.lastActive = time.Now()
+}
+
+func (s *streamableSession) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+}
+
+// idleSince returns how long the session has had no request nor open stream.
+func (s *streamableSession) idleSince(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attached > 0 {
+		return 0
+	}
+	return now.Sub(s.lastActive)
+}
+
+func (s *streamableSession) close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+func formatEventID(streamID string, id uint64) string {
+	return fmt.Sprintf("%s-%d", streamID, id)
+}
+
+func parseEventID(eventID string) (string, uint64, error) {
+	streamID, seq, ok := strings.Cut(eventID, "-")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed event ID: %s", eventID)
+	}
+	id, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed event ID: %s", eventID)
+	}
+	return streamID, id, nil
+}
+
+// accepts reports whether the Accept header of the request allows the media type.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			part, _, _ = strings.Cut(part, ";")
+			part = strings.TrimSpace(part)
+			if part == mediaType || part == "*/*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeJSONRPCError(w http.ResponseWriter, status int, code int, message string) {
+	var response mcp.JSONRPCError
+	response.JSONRPC = mcp.JSONRPC_VERSION
+	response.Error.Code = code
+	response.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const tlsFilePollInterval = 5 * time.Second
+
+// TLSConfig is the certificate the network transports are served with, and the CA of client certificates for mutual TLS.
+type TLSConfig struct {
+	CertFile     string // PEM certificate chain
+	KeyFile      string // PEM private key of the certificate
+	ClientCAFile string // PEM CA certificates. clients must present a certificate signed by one of them if set
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// tlsFiles loads the TLS files, and reloads them when they change, such as when cert-manager renews the certificate.
+type tlsFiles struct {
+	config TLSConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+}
+
+func newTLSFiles(config TLSConfig) (*tlsFiles, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("both a TLS certificate and its key are required")
+	}
+	f := &tlsFiles{config: config}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *tlsFiles) filenames() []string {
+	filenames := []string{f.config.CertFile, f.config.KeyFile}
+	if f.config.ClientCAFile != "" {
+		filenames = append(filenames, f.config.ClientCAFile)
+	}
+	return filenames
+}
+
+// reload reads the files again if any of them has changed since the last read.
+func (f *tlsFiles) reload() (bool, error) {
+	filenames := f.filenames()
+	modTimes := make([]time.Time, len(filenames))
+	for i, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false, fmt.Errorf("failed to read TLS file: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	f.mu.RLock()
+	unchanged := len(f.modTimes) == len(modTimes)
+	for i := range f.modTimes {
+		unchanged = unchanged && f.modTimes[i].Equal(modTimes[i])
+	}
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.config.CertFile, f.config.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if f.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(f.config.ClientCAFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificate found in client CA file %s", f.config.ClientCAFile)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cert = &cert
+	f.clientCAs = clientCAs
+	f.modTimes = modTimes
+	return true, nil
+}
+
+// watch polls the files until ctx is done. New connections use the reloaded files.
+func (f *tlsFiles) watch(ctx context.Context) {
+	ticker := time.NewTicker(tlsFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := f.reload()
+			if err != nil {
+				// keep serving the current certificate, the files may be in the middle of being replaced
+				slog.Warn("• Failed to reload TLS files. Keeping the current certificate", "error", err)
+			} else if changed {
+				slog.Info("• TLS certificate is reloaded", "file", f.config.CertFile)
+			}
+		}
+	}
+}
+
+// tlsConfig returns the config of the HTTP server, which picks up the current files on each handshake.
+// Client certificates are verified against the client CA only if verifyClients is set.
+func (f *tlsFiles) tlsConfig(verifyClients bool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			f.mu.RLock()
+			defer f.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*f.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if verifyClients && f.clientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = f.clientCAs
+			}
+			return config, nil
+		},
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const writeWindowPollInterval = 2 * time.Second
+
+// WriteWindowConfig starts the server read-only and enables mutating tools only for a limited time.
+// The window is opened by a signal, the admin endpoint or the control file.
+type WriteWindowConfig struct {
+	Duration    time.Duration // how long mutating tools stay enabled. 0 disables the feature
+	ControlFile string        // creating or touching this file opens the window, removing it closes the window
+	AdminToken  string        // bearer token of the admin endpoint. the endpoint is disabled if empty
+}
+
+func (c WriteWindowConfig) enabled() bool {
+	return c.Duration > 0
+}
+
+type writeWindow struct {
+	config WriteWindowConfig
+	srv    *server.MCPServer
+	tools  []server.ServerTool
+
+	mu         sync.Mutex
+	until      time.Time
+	timer      *time.Timer
+	generation int
+}
+
+func newWriteWindow(config WriteWindowConfig) *writeWindow {
+	if !config.enabled() {
+		return nil
+	}
+	return &writeWindow{config: config}
+}
+
+// register adds read-only tools to the server and keeps mutating tools until the window opens.
+func (w *writeWindow) register(srv *server.MCPServer, tools []operationTool) {
+	w.srv = srv
+
+	var readTools []server.ServerTool
+	for _, tool := range tools {
+		if tool.mutating() {
+			w.tools = append(w.tools, tool.ServerTool)
+		} else {
+			readTools = append(readTools, tool.ServerTool)
+		}
+	}
+	srv.AddTools(readTools...)
+}
+
+func (w *writeWindow) isOpen() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Now().Before(w.until)
+}
+
+// open enables mutating tools for the given duration, or extends the window if it is already open.
+func (w *writeWindow) open(duration time.Duration, source string) time.Time {
+	if duration <= 0 {
+		duration = w.config.Duration
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wasOpen := w.timer != nil
+	if wasOpen {
+		w.timer.Stop()
+	}
+	w.until = time.Now().Add(duration)
+	w.generation++
+	generation := w.generation
+	w.timer = time.AfterFunc(duration, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		// the window was extended or closed in the meantime
+		if w.generation == generation {
+			w.closeLocked("timeout")
+		}
+	})
+
+	if !wasOpen {
+		// AddTools notifies every session with tools/list_changed
+		w.srv.AddTools(w.tools...)
+	}
+	slog.Warn("• Write window is opened. Mutating tools are enabled", "source", source, "until", w.until.Format(time.RFC3339), "tools", len(w.tools))
+	return w.until
+}
+
+// close disables mutating tools.
+func (w *writeWindow) close(source string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeLocked(source)
+}
+
+func (w *writeWindow) closeLocked(source string) {
+	if w.timer == nil {
+		return
+	}
+	w.timer.Stop()
+	w.timer = nil
+	w.until = time.Time{}
+	w.generation++
+
+	names := make([]string, len(w.tools))
+	for i, tool := range w.tools {
+		names[i] = tool.Tool.Name
+	}
+	// DeleteTools notifies every session with tools/list_changed
+	w.srv.DeleteTools(names...)
+	slog.Warn("• Write window is closed. Mutating tools are disabled", "source", source)
+}
+
+// middleware rejects mutating calls that arrive after the window is closed.
+func (w *writeWindow) middleware(tool operationTool, next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	if !tool.mutating() {
+		return next
+	}
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if !w.isOpen() {
+			slog.Warn("• Tool call is rejected. The write window is closed", "tool", tool.Tool.Name, "instance", tool.client.instance)
+			return mcp.NewToolResultError("Mutating tools are disabled because the write window is closed. The request was not sent to QueryPie."), nil
+		}
+		return next(ctx, request)
+	}
+}
+
+// watch opens and closes the window on signals and control file changes until ctx is done.
+func (w *writeWindow) watch(ctx context.Context) {
+	go w.watchSignals(ctx)
+	if w.config.ControlFile != "" {
+		go w.watchControlFile(ctx)
+	}
+}
+
+// watchControlFile polls the control file. The file may contain a duration such as "15m".
+func (w *writeWindow) watchControlFile(ctx context.Context) {
+	var lastModTime time.Time
+	if info, err := os.Stat(w.config.ControlFile); err == nil {
+		// do not open the window for a file left over from a previous run
+		lastModTime = info.ModTime()
+	}
+
+	ticker := time.NewTicker(writeWindowPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(w.config.ControlFile)
+		if os.IsNotExist(err) {
+			if !lastModTime.IsZero() {
+				lastModTime = time.Time{}
+				w.close("control file removed")
+			}
+			continue
+		} else if err != nil {
+			slog.Debug("failed to stat write window control file", "error", err)
+			continue
+		}
+
+		if info.ModTime().Equal(lastModTime) {
+			continue
+		}
+		lastModTime = info.ModTime()
+
+		var duration time.Duration
+		if content, err := os.ReadFile(w.config.ControlFile); err == nil && strings.TrimSpace(string(content)) != "" {
+			duration, err = time.ParseDuration(strings.TrimSpace(string(content)))
+			if err != nil {
+				slog.Warn("• Malformed duration in write window control file. Using the default", "error", err)
+			}
+		}
+		w.open(duration, "control file")
+	}
+}
+
+// ServeHTTP handles the admin endpoint.
+// POST opens the window (optionally with {"duration": "15m"}), DELETE closes it and GET reports its state.
+func (w *writeWindow) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r, w.config.AdminToken) {
+		slog.Warn("• Unauthorized request to the write window endpoint", "remote", r.RemoteAddr)
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	source := fmt.Sprintf("admin endpoint (%s)", r.RemoteAddr)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Duration string `json:"duration"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(rw, "Malformed request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var duration time.Duration
+		if body.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(body.Duration); err != nil || duration <= 0 {
+				http.Error(rw, "Malformed duration", http.StatusBadRequest)
+				return
+			}
+		}
+		w.open(duration, source)
+	case http.MethodDelete:
+		w.close(source)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.mu.Lock()
+	status := struct {
+		Open  bool       `json:"open"`
+		Until *time.Time `json:"until,omitempty"`
+	}{Open: w.timer != nil}
+	if status.Open {
+		until := w.until // encoded after the lock is released
+		status.Until = &until
+	}
+	w.mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(status)
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package server
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchSignals opens the window on SIGUSR1 and closes it on SIGUSR2.
+func (w *writeWindow) watchSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGUSR1 {
+				w.open(0, "signal SIGUSR1")
+			} else {
+				w.close("signal SIGUSR2")
+			}
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package server
+
+import (
+	"context"
+)
+
+// watchSignals does nothing on Windows, which has no user signals.
+// Use the control file or the admin endpoint instead.
+func (w *writeWindow) watchSignals(ctx context.Context) {}